@@ -0,0 +1,37 @@
+#!/bin/bash
+
+# Measures how long it takes until every node of an N-node cluster (20 by default) answers
+# on the agent's health port. Usage: ./bench-start.sh [nodes] [rootfs]
+
+set -euo pipefail
+
+script_dir=$( cd -- "$( dirname -- "${BASH_SOURCE[0]}" )" &> /dev/null && pwd )
+
+nodes=${1:-20}
+rootfs=${2:-/var/lib/firework/rootfs/rootfs.alp.squashfs}
+
+work_dir=$(mktemp -d)
+trap 'cd $work_dir && sudo $script_dir/firework stop > /dev/null 2>&1 || true; rm -rf $work_dir' EXIT
+cd $work_dir
+
+# A /24 subnet fits up to 253 nodes. IPAM hands out addresses from 172.18.0.2 upwards.
+{
+    echo '{ "subnet_cidr": "172.18.0.0/24", "gateway": "172.18.0.1/24", "nodes": ['
+    for i in $(seq 1 $nodes); do
+        sep=$([ $i -lt $nodes ] && echo "," || echo "")
+        echo "{ \"name\": \"node-$i\", \"vcpu\": 1, \"memory\": 256, \"rootfs_path\": \"$rootfs\", \"disk\": 4 }$sep"
+    done
+    echo '] }'
+} > config.json
+
+start=$(date +%s.%N)
+nohup sudo $script_dir/firework start > firework.log 2>&1 &
+
+for i in $(seq 2 $((nodes + 1))); do
+    while ! nc -z 172.18.0.$i 3000 2> /dev/null; do
+        sleep 0.05
+    done
+done
+
+end=$(date +%s.%N)
+echo "Started $nodes nodes in $(echo "$end - $start" | bc) seconds"
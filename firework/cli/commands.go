@@ -2,10 +2,19 @@ package cli
 
 import (
 	"github.com/jlkiri/firework/cmd/connect"
+	"github.com/jlkiri/firework/cmd/doctor"
+	"github.com/jlkiri/firework/cmd/drive"
+	"github.com/jlkiri/firework/cmd/events"
+	"github.com/jlkiri/firework/cmd/inspect"
+	"github.com/jlkiri/firework/cmd/limit"
 	"github.com/jlkiri/firework/cmd/logs"
+	"github.com/jlkiri/firework/cmd/mem"
+	"github.com/jlkiri/firework/cmd/pause"
+	"github.com/jlkiri/firework/cmd/snapshot"
 	"github.com/jlkiri/firework/cmd/start"
 	"github.com/jlkiri/firework/cmd/status"
 	"github.com/jlkiri/firework/cmd/stop"
+	"github.com/jlkiri/firework/cmd/volume"
 	"github.com/spf13/cobra"
 )
 
@@ -14,5 +23,15 @@ func AddCommands(cmd *cobra.Command) {
 	cmd.AddCommand(connect.NewConnectCommand())
 	cmd.AddCommand(stop.NewStopCommand())
 	cmd.AddCommand(status.NewStatusCommand())
+	cmd.AddCommand(inspect.NewInspectCommand())
+	cmd.AddCommand(events.NewEventsCommand())
 	cmd.AddCommand(logs.NewLogsCommand())
+	cmd.AddCommand(limit.NewLimitCommand())
+	cmd.AddCommand(volume.NewVolumeCommand())
+	cmd.AddCommand(drive.NewDriveCommand())
+	cmd.AddCommand(snapshot.NewSnapshotCommand())
+	cmd.AddCommand(pause.NewPauseCommand())
+	cmd.AddCommand(pause.NewResumeCommand())
+	cmd.AddCommand(mem.NewMemCommand())
+	cmd.AddCommand(doctor.NewDoctorCommand())
 }
@@ -0,0 +1,50 @@
+package doctor
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/doctor"
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+func NewDoctorCommand() *cobra.Command {
+	firecrackerBin := ""
+	jailerBin := ""
+
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check whether the host can run a VM cluster",
+		Long: `Check KVM access, the kernel and Firecracker versions, required tools, iptables,
+IP forwarding, br_netfilter, the subnet from config.json and free disk space. These checks also run before start.`,
+		Args: cobra.NoArgs,
+		// Failed checks are not usage errors.
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDoctor(firecrackerBin, jailerBin)
+		},
+	}
+
+	doctorCmd.Flags().StringVar(&firecrackerBin, "firecracker-bin", "", "Path of the Firecracker binary")
+	doctorCmd.Flags().StringVar(&jailerBin, "jailer-bin", "", "Path of the jailer binary")
+	return doctorCmd
+}
+
+func runDoctor(firecrackerBin, jailerBin string) error {
+	conf, err := config.Read("config.json")
+	if err != nil {
+		return err
+	}
+
+	bins, err := vm.FindBinaries(conf, firecrackerBin, jailerBin)
+	results := doctor.Run(conf, bins, err)
+	doctor.Print(os.Stdout, results)
+
+	if doctor.Failed(results) {
+		return fmt.Errorf("some checks failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package drive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func NewDriveCommand() *cobra.Command {
+	driveCmd := &cobra.Command{
+		Use:   "drive",
+		Short: "Manage drives of running VMs",
+		Long:  `Manage drives of running VMs`,
+	}
+
+	driveCmd.AddCommand(newUpdateCommand())
+	return driveCmd
+}
+
+func newUpdateCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "update <name> <drive-id> <path>",
+		Short: "Swap the backing file of a drive",
+		Long: `Swap the backing file of a drive of a running VM.
+The guest should unmount the drive before the swap and mount it again afterwards.`,
+		Args: cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUpdate(args[0], args[1], args[2])
+		},
+	}
+}
+
+func runUpdate(name, driveId, path string) error {
+	conf, err := config.Read("config.json")
+	if err != nil {
+		return err
+	}
+
+	// A jailed VMM can only open files inside its chroot.
+	if conf.Jailer != nil {
+		return fmt.Errorf("drive updates are not supported in jailer mode")
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(absPath); err != nil {
+		return err
+	}
+
+	// Logger that logs to /dev/null to hide Firecracker binary output
+	logrus.SetOutput(io.Discard)
+
+	ctx := context.Background()
+	m, _, err := vm.ConnectByName(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := m.UpdateGuestDrive(ctx, driveId, absPath); err != nil {
+		return fmt.Errorf("failed to update drive %s of %s: %w", driveId, name, err)
+	}
+
+	return nil
+}
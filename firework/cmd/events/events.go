@@ -0,0 +1,114 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/events"
+	"github.com/spf13/cobra"
+)
+
+type eventsFlags struct {
+	follow bool
+	since  string
+	output string
+}
+
+func NewEventsCommand() *cobra.Command {
+	flags := eventsFlags{}
+
+	eventsCmd := &cobra.Command{
+		Use:   "events [name...]",
+		Short: "View lifecycle events of VMs",
+		Long: `View the lifecycle events of VMs from the event journal: created, booted, ready, exited with its exit code,
+restarted and network_changed. Only events of the named VMs are shown if names are given.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runEvents(args, flags)
+		},
+	}
+
+	eventsCmd.Flags().BoolVarP(&flags.follow, "follow", "f", false, "Keep printing new events until interrupted")
+	eventsCmd.Flags().StringVar(&flags.since, "since", "", "Only show events since a duration ago, e.g. 10m, or since a time in RFC 3339 format")
+	eventsCmd.Flags().StringVarP(&flags.output, "output", "o", "", "Output format: json prints an event per line")
+	return eventsCmd
+}
+
+// parseSince parses a duration before now or an RFC 3339 time.
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %s, must be a duration or an RFC 3339 time", since)
+	}
+
+	return t, nil
+}
+
+func runEvents(names []string, flags eventsFlags) error {
+	if flags.output != "" && flags.output != "json" {
+		return fmt.Errorf("unknown output format %q, must be json", flags.output)
+	}
+
+	since, err := parseSince(flags.since)
+	if err != nil {
+		return err
+	}
+
+	print := printEvent
+	if flags.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		print = func(e events.Event) error {
+			return enc.Encode(e)
+		}
+	}
+
+	filter := events.Filter{Since: since, Machines: names}
+	if !flags.follow {
+		return events.Read(config.EventsPath, filter, print)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return events.Follow(ctx, config.EventsPath, filter, print)
+}
+
+func printEvent(e events.Event) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s  %-15s  %s", e.Time.Format(time.RFC3339Nano), e.Type, e.Machine)
+
+	if e.ExitCode != nil {
+		fmt.Fprintf(&b, "  exit_code=%d", *e.ExitCode)
+	}
+
+	keys := make([]string, 0, len(e.Details))
+	for k := range e.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  %s=%v", k, e.Details[k])
+	}
+
+	if e.Error != "" {
+		fmt.Fprintf(&b, "  error=%q", e.Error)
+	}
+
+	_, err := fmt.Println(b.String())
+	return err
+}
@@ -0,0 +1,168 @@
+package inspect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/state"
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func NewInspectCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect <name>",
+		Short: "Describe a VM as JSON",
+		Long: `Print the effective configuration of a VM as JSON: its state, the configuration reported by Firecracker
+with drives, network interfaces and kernel arguments, the MMDS contents, the host resources it uses
+and the node config it was created from, which may differ from config.json.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runInspect(args[0])
+		},
+	}
+}
+
+// Host lists the files and devices on the host that belong to a machine.
+type Host struct {
+	Tap             string `json:"tap"`
+	SocketPath      string `json:"socket_path"`
+	VsockPath       string `json:"vsock_path"`
+	LogFifoPath     string `json:"log_fifo_path"`
+	MetricsFifoPath string `json:"metrics_fifo_path"`
+	StdioPath       string `json:"stdio_path"`
+	OverlayPath     string `json:"overlay_path,omitempty"` // Empty for a ram overlay
+	VmmLogPath      string `json:"vmm_log_path"`
+}
+
+// Inspection is the description of a machine. Parts that can only be queried from a running
+// machine are omitted if it is not running, and Errors lists the parts that could not be queried.
+type Inspection struct {
+	Name     string               `json:"name"`
+	State    state.Machine        `json:"state"`
+	Instance *models.InstanceInfo `json:"instance,omitempty"`
+	// Firecracker is the configuration reported by the API socket, including the boot source with
+	// the kernel arguments, drives and network interfaces.
+	Firecracker *models.FullVMConfiguration `json:"firecracker,omitempty"`
+	Mmds        interface{}                 `json:"mmds,omitempty"`
+	Host        Host                        `json:"host"`
+	// Node is the node config the machine was created from. NodeChanged is true if the node in
+	// config.json has changed since.
+	Node        *config.Node `json:"node,omitempty"`
+	NodeChanged bool         `json:"node_changed"`
+	Errors      []string     `json:"errors,omitempty"`
+}
+
+func (i *Inspection) addError(format string, args ...any) {
+	i.Errors = append(i.Errors, fmt.Sprintf(format, args...))
+}
+
+func runInspect(name string) error {
+	// Logger that logs to /dev/null to hide Firecracker binary output
+	logrus.SetOutput(io.Discard)
+
+	store, err := state.OpenExisting(config.DbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	record, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+
+	inspection := Inspection{
+		Name:  name,
+		State: record,
+		Host: Host{
+			Tap:             record.Tap,
+			SocketPath:      record.SocketPath,
+			VsockPath:       record.VsockPath,
+			LogFifoPath:     config.LogFifoPath(record.VmId),
+			MetricsFifoPath: config.MetricsFifoPath(record.VmId),
+			StdioPath:       config.StdioPath(record.VmId),
+			VmmLogPath:      config.VmmLogPath,
+			OverlayPath:     vm.OverlayDrive(record.VmId),
+		},
+	}
+
+	inspectNode(&inspection, record)
+
+	if record.Running() {
+		inspectMachine(&inspection, record)
+	}
+
+	b, err := json.MarshalIndent(inspection, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(b))
+	return nil
+}
+
+func inspectNode(inspection *Inspection, record state.Machine) {
+	// Machines started by an older firework have no recorded config.
+	var node config.Node
+	if record.Config == "" {
+		inspection.addError("node config was not recorded")
+	} else if err := json.Unmarshal([]byte(record.Config), &node); err != nil {
+		inspection.addError("failed to decode node config: %s", err)
+	} else {
+		inspection.Node = &node
+	}
+
+	conf, err := config.Read("config.json")
+	if err != nil {
+		inspection.addError("failed to read config.json: %s", err)
+		return
+	}
+
+	for _, node := range conf.Nodes {
+		if node.Name == record.Name {
+			inspection.NodeChanged = node.Hash() != record.ConfigHash
+			return
+		}
+	}
+
+	inspection.addError("node %s is not in config.json", record.Name)
+	inspection.NodeChanged = true
+}
+
+func inspectMachine(inspection *Inspection, record state.Machine) {
+	ctx, cancel := context.WithTimeout(context.Background(), vm.QueryTimeout)
+	defer cancel()
+
+	m, err := vm.Connect(ctx, record.VmId)
+	if err != nil {
+		inspection.addError("%s", err)
+		return
+	}
+
+	instance, err := m.DescribeInstanceInfo(ctx)
+	if err != nil {
+		inspection.addError("failed to describe instance: %s", err)
+	} else {
+		inspection.Instance = &instance
+	}
+
+	cfg, err := vm.ExportConfig(m)
+	if err != nil {
+		inspection.addError("failed to export config: %s", err)
+	} else {
+		inspection.Firecracker = cfg
+	}
+
+	var mmds interface{}
+	if err := m.GetMetadata(ctx, &mmds); err != nil {
+		inspection.addError("failed to get MMDS contents: %s", err)
+	} else {
+		inspection.Mmds = mmds
+	}
+}
@@ -0,0 +1,94 @@
+package limit
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Rates given on the command line are per second, so buckets refill every second.
+const refillTimeMs = 1000
+
+type limitFlags struct {
+	netInBandwidth  int64
+	netInPackets    int64
+	netOutBandwidth int64
+	netOutPackets   int64
+	diskBandwidth   int64
+	diskOps         int64
+}
+
+func NewLimitCommand() *cobra.Command {
+	flags := limitFlags{}
+
+	limitCmd := &cobra.Command{
+		Use:   "limit <name>",
+		Short: "Update rate limits of a running VM",
+		Long: `Update network and disk rate limits of a running VM.
+Rates are per second. A rate of 0 removes the limit. Limits that are not specified are left unchanged.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runLimit(cmd, args[0], flags)
+		},
+	}
+
+	limitCmd.Flags().Int64Var(&flags.netInBandwidth, "net-in-bandwidth", 0, "Inbound network bandwidth in bytes per second")
+	limitCmd.Flags().Int64Var(&flags.netInPackets, "net-in-packets", 0, "Inbound network packets per second")
+	limitCmd.Flags().Int64Var(&flags.netOutBandwidth, "net-out-bandwidth", 0, "Outbound network bandwidth in bytes per second")
+	limitCmd.Flags().Int64Var(&flags.netOutPackets, "net-out-packets", 0, "Outbound network packets per second")
+	limitCmd.Flags().Int64Var(&flags.diskBandwidth, "disk-bandwidth", 0, "Disk bandwidth of the root filesystem in bytes per second")
+	limitCmd.Flags().Int64Var(&flags.diskOps, "disk-ops", 0, "Disk operations of the root filesystem per second")
+
+	return limitCmd
+}
+
+// rateLimiter builds a rate limiter from a pair of flags or returns nil if neither was set.
+func rateLimiter(cmd *cobra.Command, bandwidthFlag string, bandwidth int64, opsFlag string, ops int64) *config.RateLimiter {
+	bandwidthSet := cmd.Flags().Changed(bandwidthFlag)
+	opsSet := cmd.Flags().Changed(opsFlag)
+	if !bandwidthSet && !opsSet {
+		return nil
+	}
+
+	rl := &config.RateLimiter{}
+	if bandwidthSet {
+		rl.Bandwidth = &config.TokenBucket{Size: bandwidth, RefillTimeMs: refillTimeMs}
+	}
+	if opsSet {
+		rl.Ops = &config.TokenBucket{Size: ops, RefillTimeMs: refillTimeMs}
+	}
+
+	return rl
+}
+
+func runLimit(cmd *cobra.Command, name string, flags limitFlags) error {
+	limits := config.RateLimits{
+		NetworkIn:  rateLimiter(cmd, "net-in-bandwidth", flags.netInBandwidth, "net-in-packets", flags.netInPackets),
+		NetworkOut: rateLimiter(cmd, "net-out-bandwidth", flags.netOutBandwidth, "net-out-packets", flags.netOutPackets),
+		Disk:       rateLimiter(cmd, "disk-bandwidth", flags.diskBandwidth, "disk-ops", flags.diskOps),
+	}
+
+	if limits.NetworkIn == nil && limits.NetworkOut == nil && limits.Disk == nil {
+		return fmt.Errorf("no limits specified")
+	}
+
+	// Logger that logs to /dev/null to hide Firecracker binary output
+	logrus.SetOutput(io.Discard)
+
+	ctx := context.Background()
+	m, _, err := vm.ConnectByName(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := vm.UpdateRateLimits(ctx, m, limits); err != nil {
+		return fmt.Errorf("failed to update rate limits of %s: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package mem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	units "github.com/docker/go-units"
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func NewMemCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "mem <name> <target>",
+		Short: "Change the memory of a running VM",
+		Long: `Change the memory available to a running VM by resizing its balloon device.
+The target is in MiB or has a unit, e.g. 512M or 1G, and cannot exceed the configured memory of the node.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMem(args[0], args[1])
+		},
+	}
+}
+
+// parseMib parses a plain number of MiB or a size with a unit.
+func parseMib(target string) (int64, error) {
+	if mib, err := strconv.ParseInt(target, 10, 64); err == nil {
+		return mib, nil
+	}
+
+	bytes, err := units.RAMInBytes(target)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory target %s: %w", target, err)
+	}
+
+	return bytes / units.MiB, nil
+}
+
+func runMem(name, target string) error {
+	targetMib, err := parseMib(target)
+	if err != nil {
+		return err
+	}
+
+	// Logger that logs to /dev/null to hide Firecracker binary output
+	logrus.SetOutput(io.Discard)
+
+	ctx := context.Background()
+	m, _, err := vm.ConnectByName(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := vm.SetMemoryTarget(ctx, m, targetMib); err != nil {
+		return fmt.Errorf("failed to change memory of %s: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package pause
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func NewPauseCommand() *cobra.Command {
+	return newCommand(
+		"pause",
+		"Pause running VMs",
+		`Pause the vCPUs of running VMs, e.g. to simulate a hanging node or a long GC pause.
+Paused VMs keep their memory and network devices and can be continued with resume.`,
+		func(ctx context.Context, mg *vm.MachineGroup, names []string) ([]string, error) {
+			return mg.Pause(ctx, names...)
+		},
+	)
+}
+
+func NewResumeCommand() *cobra.Command {
+	return newCommand(
+		"resume",
+		"Resume paused VMs",
+		`Resume VMs that were paused with pause`,
+		func(ctx context.Context, mg *vm.MachineGroup, names []string) ([]string, error) {
+			return mg.Resume(ctx, names...)
+		},
+	)
+}
+
+type action func(ctx context.Context, mg *vm.MachineGroup, names []string) ([]string, error)
+
+func newCommand(use, short, long string, run action) *cobra.Command {
+	all := false
+
+	cmd := &cobra.Command{
+		Use:   use + " <name>... | --all",
+		Short: short,
+		Long:  long,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if all == (len(args) > 0) {
+				return fmt.Errorf("specify either machine names or --all")
+			}
+
+			// Logger that logs to /dev/null to hide Firecracker binary output
+			logrus.SetOutput(io.Discard)
+
+			ctx := context.Background()
+			mg, err := vm.AttachMachineGroup(ctx)
+			if err != nil {
+				return err
+			}
+
+			names, err := run(ctx, mg, args)
+			for _, name := range names {
+				fmt.Println(name)
+			}
+
+			return err
+		},
+	}
+
+	cmd.Flags().BoolVarP(&all, "all", "a", false, "Apply to all running VMs")
+	return cmd
+}
@@ -0,0 +1,164 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlkiri/firework/cmd/start"
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/output"
+	"github.com/jlkiri/firework/internal/snapshot"
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func NewSnapshotCommand() *cobra.Command {
+	snapshotCmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Manage VM snapshots",
+		Long:  `Create snapshots of running machines and restore clusters from them`,
+	}
+
+	snapshotCmd.AddCommand(newCreateCommand())
+	snapshotCmd.AddCommand(newListCommand())
+	snapshotCmd.AddCommand(newRemoveCommand())
+	snapshotCmd.AddCommand(start.NewRestoreCommand())
+
+	return snapshotCmd
+}
+
+func newCreateCommand() *cobra.Command {
+	name := ""
+
+	createCmd := &cobra.Command{
+		Use:   "create <node|cluster>",
+		Short: "Create a snapshot",
+		Long:  `Create a snapshot of a single node or, if the cluster name is given, of all nodes of the cluster`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCreate(args[0], name)
+		},
+	}
+
+	createCmd.Flags().StringVarP(&name, "name", "n", "", "Name of the snapshot (default: the node or cluster name)")
+	return createCmd
+}
+
+func newListCommand() *cobra.Command {
+	opts := output.Options{}
+
+	listCmd := &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List snapshots",
+		Long:    `List snapshots`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runList(opts)
+		},
+	}
+
+	output.AddFlags(listCmd, &opts)
+	return listCmd
+}
+
+func newRemoveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "rm <name>...",
+		Aliases: []string{"remove"},
+		Short:   "Remove snapshots",
+		Long:    `Remove snapshots`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRemove(args)
+		},
+	}
+}
+
+func runCreate(target, name string) error {
+	// Logger that logs to /dev/null to hide Firecracker binary output
+	logrus.SetOutput(io.Discard)
+
+	conf, err := config.Read("config.json")
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		name = target
+	}
+
+	nodes := []string{target}
+	if target == conf.ClusterName() {
+		records, err := vm.ReadMachines()
+		if err != nil {
+			return err
+		}
+
+		running := make(map[string]bool, len(records))
+		for _, record := range records {
+			running[record.Name] = record.Running()
+		}
+
+		nodes = nodes[:0]
+		for _, node := range conf.Nodes {
+			if running[node.Name] {
+				nodes = append(nodes, node.Name)
+			}
+		}
+	}
+
+	manifest, err := snapshot.Create(context.Background(), name, conf, nodes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(manifest.Name)
+	return nil
+}
+
+func runList(opts output.Options) error {
+	manifests, err := snapshot.List()
+	if err != nil {
+		return err
+	}
+
+	return opts.Print(os.Stdout, manifests, func(wide bool) output.Table {
+		header := []string{"NAME", "CLUSTER", "MACHINES", "CREATED"}
+		if wide {
+			header = append(header, "NODES")
+		}
+
+		table := output.Table{Header: header}
+		for _, m := range manifests {
+			row := []string{m.Name, m.Config.ClusterName(), strconv.Itoa(len(m.Machines)), m.CreatedAt.Format(time.RFC3339)}
+			if wide {
+				names := make([]string, len(m.Machines))
+				for i, machine := range m.Machines {
+					names[i] = machine.Name
+				}
+				row = append(row, strings.Join(names, ","))
+			}
+			table.Rows = append(table.Rows, row)
+		}
+		return table
+	})
+}
+
+func runRemove(names []string) error {
+	for _, name := range names {
+		if err := snapshot.Remove(name); err != nil {
+			return err
+		}
+
+		fmt.Println(name)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package start
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/dns"
+	"github.com/jlkiri/firework/internal/network"
+	"golang.org/x/exp/slog"
+)
+
+// resolver holds the DNS settings of a cluster with host defaults applied.
+type resolver struct {
+	bridgeIp      string
+	zone          string
+	upstreams     []string
+	searchDomains []string
+}
+
+func newResolver(conf config.Config, bridge *network.BridgeNetwork) (resolver, error) {
+	r := resolver{
+		bridgeIp:      bridge.GetIPAddr().String(),
+		zone:          strings.TrimSuffix(dns.Zone(conf.ClusterName()), "."),
+		upstreams:     conf.Nameservers,
+		searchDomains: conf.SearchDomains,
+	}
+
+	if len(r.upstreams) > 0 && len(r.searchDomains) > 0 {
+		return r, nil
+	}
+
+	host, err := dns.ReadHostResolvConf()
+	if err != nil {
+		return resolver{}, err
+	}
+
+	if len(r.upstreams) == 0 {
+		r.upstreams = host.Nameservers
+	}
+
+	if len(r.searchDomains) == 0 {
+		r.searchDomains = host.SearchDomains
+	}
+
+	return r, nil
+}
+
+// guest returns the nameservers and search domains of a node. The built-in DNS server always comes
+// first, followed by the node's own nameservers or the cluster upstreams reachable from the guest.
+func (r resolver) guest(node config.Node) ([]string, []string) {
+	nameservers := []string{r.bridgeIp}
+	if len(node.Nameservers) > 0 {
+		nameservers = append(nameservers, node.Nameservers...)
+	} else {
+		nameservers = append(nameservers, dns.RoutableNameservers(r.upstreams)...)
+	}
+
+	searchDomains := []string{r.zone}
+	if len(node.SearchDomains) > 0 {
+		searchDomains = append(searchDomains, node.SearchDomains...)
+	} else {
+		searchDomains = append(searchDomains, r.searchDomains...)
+	}
+
+	return nameservers, searchDomains
+}
+
+// startDnsServer serves cluster records on the bridge IP and forwards other queries to the upstreams.
+func startDnsServer(ctx context.Context, cluster string, bridge *network.BridgeNetwork, upstreams []string) (*dns.Server, error) {
+	server := dns.NewServer(cluster, upstreams)
+	if err := server.Listen(bridge.GetIPAddr()); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := server.Serve(ctx); err != nil {
+			slog.Error("DNS server stopped", "error", err)
+		}
+	}()
+
+	return server, nil
+}
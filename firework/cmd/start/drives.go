@@ -0,0 +1,57 @@
+package start
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/vm"
+)
+
+// Firecracker only accepts drive IDs made of alphanumeric characters and underscores.
+var validDriveId = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// imageDrives resolves the additional drives of a node and the mounts the guest agent performs.
+func imageDrives(node config.Node) ([]vm.Drive, []vm.Mount, error) {
+	drives := make([]vm.Drive, 0, len(node.Drives))
+	mounts := make([]vm.Mount, 0, len(node.Drives))
+	seen := make(map[string]bool)
+	for _, drive := range node.Drives {
+		if !validDriveId.MatchString(drive.Id) {
+			return nil, nil, fmt.Errorf("node %s: invalid drive id %q: must contain only letters, digits and '_'", node.Name, drive.Id)
+		}
+
+		// Volume drive IDs are prefixed with "vol_".
+		if vm.ReservedDriveId(drive.Id) || strings.HasPrefix(drive.Id, "vol_") || seen[drive.Id] {
+			return nil, nil, fmt.Errorf("node %s: drive id %q is already in use", node.Name, drive.Id)
+		}
+		seen[drive.Id] = true
+
+		path, err := config.AbsPath(drive.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			return nil, nil, fmt.Errorf("node %s: drive %s: %w", node.Name, drive.Id, err)
+		}
+
+		drives = append(drives, vm.Drive{
+			Id:         drive.Id,
+			PathOnHost: path,
+			ReadOnly:   drive.ReadOnly,
+		})
+
+		if drive.MountPath != "" {
+			mounts = append(mounts, vm.Mount{
+				DriveId:  drive.Id,
+				Path:     drive.MountPath,
+				ReadOnly: drive.ReadOnly,
+			})
+		}
+	}
+
+	return drives, mounts, nil
+}
@@ -18,6 +18,10 @@ func prepareEnvironment() error {
 		return err
 	}
 
+	if err := os.RemoveAll(config.JailerDir); err != nil {
+		return err
+	}
+
 	if err := os.MkdirAll(config.KernelDir, 0755); err != nil {
 		return err
 	}
@@ -34,6 +38,10 @@ func prepareEnvironment() error {
 		return err
 	}
 
+	if err := os.MkdirAll(config.VolumesDir, 0755); err != nil {
+		return err
+	}
+
 	ctx := context.TODO()
 	err := ensureKernel(ctx, config.KernelUrl, config.KernelPath())
 	if err != nil {
@@ -1,31 +1,131 @@
 package start
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
 
 	units "github.com/docker/go-units"
 	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/fsutil"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sync/errgroup"
 )
 
-func createOverlayDrive(vmId string, capacity int64) (string, error) {
-	path := config.OverlayDrivePath(vmId)
+// templateMu serializes creation of overlay templates so that nodes with the same
+// disk capacity do not format the same template concurrently. Concurrent firework processes
+// format their own temporary files, and the last rename wins.
+var templateMu sync.Mutex
 
-	f, err := os.Create(path)
-	if err != nil {
+// ensureOverlayTemplate returns the path of a pre-formatted sparse ext4 image of the given
+// capacity in GiB, formatting it once if it does not exist yet.
+func ensureOverlayTemplate(capacity int64) (string, error) {
+	templateMu.Lock()
+	defer templateMu.Unlock()
+
+	path := config.OverlayTemplatePath(capacity)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		return "", fmt.Errorf("mkfs.ext4 is required to create the overlay template (install e2fsprogs): %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return "", err
 	}
 
-	defer f.Close()
+	// Format a temporary file and rename it so that an interrupted mkfs never leaves a broken template.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
 
 	if err := f.Truncate(units.GiB * capacity); err != nil {
+		f.Close()
 		return "", err
 	}
 
-	_, err = exec.Command("mkfs.ext4", path).CombinedOutput()
-	if err != nil {
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	slog.Info("Formatting overlay template", "path", path, "capacity", fmt.Sprintf("%dG", capacity))
+	if out, err := exec.Command("mkfs.ext4", "-q", tmpPath).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to format overlay template: %w: %s", err, out)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
 		return "", err
 	}
 
 	return path, nil
 }
+
+// createOverlayDrives provisions the overlay drives of all nodes in parallel. The returned paths
+// are in the order of nodes and empty for nodes with a ram overlay. Restored machines get a copy
+// of the overlay drive from their snapshot. Every drive is removed again if setup is rolled back.
+func createOverlayDrives(s *setup, idents []identity, nodes []config.Node) ([]string, error) {
+	start := time.Now()
+	paths := make([]string, len(nodes))
+
+	eg := new(errgroup.Group)
+	for i, node := range nodes {
+		if node.Overlay == config.OverlayRam {
+			continue
+		}
+
+		i, ident, capacity := i, idents[i], node.Disk
+		eg.Go(func() error {
+			if err := s.check(); err != nil {
+				return err
+			}
+
+			// Registered first so that a partially written drive is removed as well.
+			path := config.OverlayDrivePath(ident.id)
+			s.onUndo("overlay drive "+path, func() error {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				return nil
+			})
+
+			if ident.snapshotOverlayPath != "" {
+				if err := fsutil.CloneFile(ident.snapshotOverlayPath, path); err != nil {
+					return fmt.Errorf("failed to restore overlay drive: %w", err)
+				}
+			} else if err := createOverlayDrive(path, capacity); err != nil {
+				return err
+			}
+
+			paths[i] = path
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Provisioned overlay drives", "count", len(nodes), "elapsed", time.Since(start))
+	return paths, nil
+}
+
+func createOverlayDrive(path string, capacity int64) error {
+	templatePath, err := ensureOverlayTemplate(capacity)
+	if err != nil {
+		return err
+	}
+
+	if err := fsutil.CloneFile(templatePath, path); err != nil {
+		return fmt.Errorf("failed to clone overlay template: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package start
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jlkiri/firework/internal/vm"
+)
+
+// waitReady waits until all machines of the group are ready, prints the boot time of each
+// machine and fails if any machine is not ready within timeout.
+func waitReady(ctx context.Context, mg *vm.MachineGroup, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := mg.WaitReady(ctx)
+
+	notReady := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tREADY\tBOOT TIME")
+	for _, r := range results {
+		if r.Err != nil {
+			notReady++
+			fmt.Fprintf(w, "%s\tfalse\t%s\n", r.Name, r.Err)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\ttrue\t%s\n", r.Name, r.BootTime.Round(time.Millisecond))
+	}
+	w.Flush()
+
+	if notReady > 0 {
+		return fmt.Errorf("%d of %d machines did not become ready within %s", notReady, len(results), timeout)
+	}
+
+	return nil
+}
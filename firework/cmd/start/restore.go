@@ -0,0 +1,71 @@
+package start
+
+import (
+	"fmt"
+
+	"github.com/jlkiri/firework/internal/snapshot"
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+)
+
+func NewRestoreCommand() *cobra.Command {
+	flags := runFlags{}
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore <snapshot>",
+		Short: "Start a VM cluster from a snapshot",
+		Long:  `Start the machines of a snapshot with their memory, state and overlay drives as they were when the snapshot was created`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRestore(args[0], flags)
+		},
+	}
+
+	addRunFlags(restoreCmd, &flags)
+	return restoreCmd
+}
+
+func runRestore(name string, flags runFlags) error {
+	defer cleanup()
+
+	manifest, err := snapshot.Read(name)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Config.Jailer != nil {
+		return fmt.Errorf("snapshots are not supported in jailer mode")
+	}
+
+	bins, err := preflight(manifest.Config, flags)
+	if err != nil {
+		return err
+	}
+
+	if err := prepareEnvironment(); err != nil {
+		return err
+	}
+	slog.Debug("Prepared environment for execution.")
+
+	return run(manifest.Config, restoredIdentities(manifest), bins, flags)
+}
+
+// restoredIdentities returns the identities recorded in a snapshot in the order of its nodes.
+func restoredIdentities(manifest snapshot.Manifest) []identity {
+	idents := make([]identity, len(manifest.Machines))
+	for i, m := range manifest.Machines {
+		idents[i] = identity{
+			id:                m.VmId,
+			cid:               m.Cid,
+			addr:              m.Ipv4,
+			snapshotMemPath:   snapshot.MemPath(manifest.Name, m.Name),
+			snapshotStatePath: snapshot.StatePath(manifest.Name, m.Name),
+		}
+
+		if m.Overlay {
+			idents[i].snapshotOverlayPath = snapshot.OverlayPath(manifest.Name, m.Name)
+		}
+	}
+
+	return idents
+}
@@ -0,0 +1,95 @@
+package start
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+)
+
+var errInterrupted = errors.New("interrupted while starting the cluster")
+
+type undoAction struct {
+	what string
+	fn   func() error
+}
+
+// setup tracks the resources created while a cluster starts. Every resource is pushed to an undo
+// stack as soon as it exists, and if starting fails or is interrupted with Ctrl+C, the stack is
+// unwound to leave the host as it was.
+type setup struct {
+	ctx  context.Context // Done when setup is interrupted
+	stop context.CancelFunc
+
+	mu   sync.Mutex
+	undo []undoAction
+}
+
+// newSetup starts catching SIGINT and SIGTERM, which would otherwise kill firework before it
+// can remove what it created so far.
+func newSetup() *setup {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return &setup{ctx: ctx, stop: stop}
+}
+
+// onUndo registers how to remove a resource that was just created. It is safe to call from
+// multiple goroutines.
+func (s *setup) onUndo(what string, fn func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.undo = append(s.undo, undoAction{what, fn})
+}
+
+func (s *setup) interrupted() bool {
+	return s.ctx.Err() != nil
+}
+
+// check returns an error if setup was interrupted.
+func (s *setup) check() error {
+	if s.interrupted() {
+		return errInterrupted
+	}
+	return nil
+}
+
+// rollback removes the created resources in reverse order. Failures are logged and do not stop
+// the remaining actions.
+func (s *setup) rollback() {
+	s.mu.Lock()
+	undo := s.undo
+	s.undo = nil
+	s.mu.Unlock()
+
+	if len(undo) > 0 {
+		slog.Info("Rolling back partially started cluster", "resources", len(undo))
+	}
+
+	for i := len(undo) - 1; i >= 0; i-- {
+		action := undo[i]
+		if err := action.fn(); err != nil {
+			slog.Error("Failed to undo", "what", action.what, "error", err)
+			continue
+		}
+		slog.Debug("Undid", "what", action.what)
+	}
+}
+
+// commit ends setup. The created resources now belong to the running cluster and are removed by
+// firework stop. Signals are no longer caught by setup.
+func (s *setup) commit() {
+	s.mu.Lock()
+	s.undo = nil
+	s.mu.Unlock()
+
+	s.stop()
+}
+
+// finish rolls back unless setup was committed. It is meant to be deferred.
+func (s *setup) finish() {
+	s.rollback()
+	s.stop()
+}
@@ -2,53 +2,145 @@ package start
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"os"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/dns"
+	"github.com/jlkiri/firework/internal/doctor"
+	"github.com/jlkiri/firework/internal/events"
 	"github.com/jlkiri/firework/internal/ipam"
 	"github.com/jlkiri/firework/internal/network"
+	"github.com/jlkiri/firework/internal/state"
 	"github.com/jlkiri/firework/internal/vm"
 	"github.com/spf13/cobra"
 	"golang.org/x/exp/slog"
 )
 
+// runFlags are the flags shared by the commands that start a cluster.
+type runFlags struct {
+	// Override the Firecracker and jailer binaries from the config.
+	firecrackerBin string
+	jailerBin      string
+	skipChecks     bool
+	// Wait until all machines are ready or the timeout expires.
+	wait    bool
+	timeout time.Duration
+}
+
+// checkNotRunning refuses to start while another firework runs a cluster, because starting resets
+// its state, IP leases and data directory.
+func checkNotRunning() error {
+	store, err := state.OpenExisting(config.DbPath)
+	if errors.Is(err, state.ErrNoCluster) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	pid, err := store.Supervisor()
+	if err != nil {
+		return fmt.Errorf("failed to read supervisor: %w", err)
+	}
+	if pid != 0 {
+		return fmt.Errorf("cluster already running (firework pid %d), stop it with firework stop", pid)
+	}
+
+	return nil
+}
+
+// preflight refuses to start while a cluster is running, resolves the Firecracker and jailer
+// binaries and, unless they are skipped, runs the checks of firework doctor and refuses to start if
+// any of them fails.
+func preflight(conf config.Config, flags runFlags) (vm.Binaries, error) {
+	if err := checkNotRunning(); err != nil {
+		return vm.Binaries{}, err
+	}
+
+	bins, err := vm.FindBinaries(conf, flags.firecrackerBin, flags.jailerBin)
+	if flags.skipChecks {
+		return bins, err
+	}
+
+	results := doctor.Run(conf, bins, err)
+	if !doctor.Failed(results) {
+		return bins, nil
+	}
+
+	doctor.Print(os.Stderr, results)
+	return vm.Binaries{}, fmt.Errorf("preflight checks failed, fix the problems above or use --skip-checks")
+}
+
+func addRunFlags(cmd *cobra.Command, flags *runFlags) {
+	cmd.Flags().StringVar(&flags.firecrackerBin, "firecracker-bin", "", "Path of the Firecracker binary (default: firecracker_bin from the config or firecracker in $PATH)")
+	cmd.Flags().StringVar(&flags.jailerBin, "jailer-bin", "", "Path of the jailer binary (default: jailer_bin from the config or jailer in $PATH)")
+	cmd.Flags().BoolVar(&flags.skipChecks, "skip-checks", false, "Start without running the checks of firework doctor")
+	cmd.Flags().BoolVarP(&flags.wait, "wait", "w", false, "Wait until all VMs are ready and exit with an error if any of them is not")
+	cmd.Flags().DurationVar(&flags.timeout, "timeout", 5*time.Minute, "How long to wait for VMs to become ready")
+}
+
 func NewStartCommand() *cobra.Command {
 	isDaemon := false
+	flags := runFlags{}
 
 	startCmd := &cobra.Command{
 		Use:   "start",
 		Short: "Start a VM cluster from config",
 		Long:  `Start a VM cluster from config`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runStart(isDaemon)
+			return runStart(isDaemon, flags)
 		},
 	}
 
 	// Add a run in background flag to start command
 	startCmd.Flags().BoolVarP(&isDaemon, "daemon", "d", false, "Run in background")
+	addRunFlags(startCmd, &flags)
 	return startCmd
 }
 
-func runStart(isDaemon bool) error {
+func runStart(isDaemon bool, flags runFlags) error {
 	defer cleanup()
 
-	// TODO: Remove this
-	os.Remove(config.DbPath)
+	conf, err := config.Read("config.json")
+	if err != nil {
+		return err
+	}
+	slog.Debug("Read config.json.", "config", conf)
+
+	bins, err := preflight(conf, flags)
+	if err != nil {
+		return err
+	}
 
 	if err := prepareEnvironment(); err != nil {
 		return err
 	}
 	slog.Debug("Prepared environment for execution.")
 
-	conf, err := config.Read("config.json")
-	if err != nil {
+	return run(conf, newIdentities(conf.Nodes), bins, flags)
+}
+
+// run creates the network and the machines of a cluster and waits until all of them exit.
+// Each node is created with the identity at the same index.
+//
+// Until all machines are started, everything created on the host is rolled back if an error occurs
+// or firework is interrupted.
+func run(conf config.Config, idents []identity, bins vm.Binaries, flags runFlags) error {
+	s := newSetup()
+	defer s.finish()
+
+	slog.Info("Using Firecracker", "path", bins.Firecracker, "version", bins.Version)
+
+	if err := checkVolumes(conf.Nodes); err != nil {
 		return err
 	}
-	slog.Debug("Read config.json.", "config", conf)
 
 	ipamDb, err := ipam.NewIPAM(config.DbPath, conf.SubnetCidr)
 	if err != nil {
@@ -56,15 +148,55 @@ func runStart(isDaemon bool) error {
 	}
 	slog.Debug("Created and populated IPAM database.")
 
+	store, err := state.Open(config.DbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.Reset(); err != nil {
+		return fmt.Errorf("failed to reset state: %w", err)
+	}
+
+	// firework stop asks this process to shut the machines down so that they are not restarted.
+	if err := store.SetSupervisor(os.Getpid()); err != nil {
+		return fmt.Errorf("failed to record supervisor: %w", err)
+	}
+	defer store.ClearSupervisor(os.Getpid())
+
+	if err := allocateCids(store, conf, idents); err != nil {
+		return err
+	}
+
+	journal, err := events.Open(config.EventsPath, conf.ClusterName())
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
 	bridge, err := network.NewBridgeNetwork(conf.SubnetCidr, conf.Gateway)
 	if err != nil {
 		return err
 	}
+	s.onUndo("bridge "+network.VM_BRIDGE_NAME, func() error {
+		return bridge.Remove(conf.SubnetCidr)
+	})
 	slog.Debug("Created a bridge network.", "cidr", conf.SubnetCidr)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	resolv, err := newResolver(conf, bridge)
+	if err != nil {
+		return fmt.Errorf("failed to resolve DNS settings: %w", err)
+	}
+
+	dnsServer, err := startDnsServer(ctx, conf.ClusterName(), bridge, resolv.upstreams)
+	if err != nil {
+		return fmt.Errorf("failed to start DNS server: %w", err)
+	}
+	slog.Debug("Started DNS server.", "addr", bridge.GetIPAddr(), "zone", dns.Zone(conf.ClusterName()), "upstreams", resolv.upstreams)
+
 	vmmLogFile, err := createVmmLogFile(config.VmmLogPath)
 	if err != nil {
 		return fmt.Errorf("failed to create VMM log fifo: %w", err)
@@ -73,12 +205,19 @@ func runStart(isDaemon bool) error {
 	defer vmmLogFile.Close()
 	slog.Debug("Created VMM log fifo", "path", config.VmmLogPath)
 
-	mg, err := createMachineGroup(ctx, conf.Nodes, bridge, ipamDb, vmmLogFile)
+	mg, err := createMachineGroup(ctx, s, conf, idents, bins, bridge, ipamDb, store, journal, vmmLogFile, dnsServer, resolv)
 	if err != nil {
+		if err := s.check(); err != nil {
+			return err
+		}
 		return fmt.Errorf("failed to create machine group: %w", err)
 	}
 	slog.Debug("Created machine group from config:", "config", conf)
 
+	if err := s.check(); err != nil {
+		return err
+	}
+
 	if err := mg.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start machine group: %w", err)
 	}
@@ -86,6 +225,28 @@ func runStart(isDaemon bool) error {
 	slog.Debug("Installing SIGTERM and SIGINT signal handlers.")
 	vm.InstallSignalHandlers(ctx, mg)
 
+	// A signal caught by setup while the machines were being started cancels the start. Machines
+	// whose VMM is still starting are stopped as soon as it started, and once all of them exited,
+	// setup is rolled back.
+	if s.interrupted() {
+		if err := mg.Shutdown(ctx); err != nil {
+			slog.Error("Failed to shut down machines", "error", err)
+		}
+		mg.Wait(ctx)
+		return errInterrupted
+	}
+	s.commit()
+
+	if flags.wait {
+		if err := waitReady(ctx, mg, flags.timeout); err != nil {
+			if err := mg.Shutdown(ctx); err != nil {
+				slog.Error("Failed to shut down machines", "error", err)
+			}
+			mg.Wait(ctx)
+			return err
+		}
+	}
+
 	if err := mg.Wait(ctx); err != nil {
 		cancel() // Stop signal handlers
 		return fmt.Errorf("an error occurred while waiting for the machine group to exit: %w", err)
@@ -95,39 +256,104 @@ func runStart(isDaemon bool) error {
 	return nil
 }
 
-func createMachineGroup(ctx context.Context, nodes []config.Node, bridge *network.BridgeNetwork, ipamDb *ipam.IPAM, fifoLogWriter io.Writer) (*vm.MachineGroup, error) {
+func createMachineGroup(ctx context.Context, s *setup, conf config.Config, idents []identity, bins vm.Binaries, bridge *network.BridgeNetwork, ipamDb *ipam.IPAM, store *state.Store, journal *events.Journal, fifoLogWriter io.Writer, dnsServer *dns.Server, resolv resolver) (*vm.MachineGroup, error) {
 	kernelPath := config.KernelPath()
 	// rootFsPath := config.RootFsPath()
 
-	mg := vm.NewMachineGroup()
+	mg := vm.NewMachineGroup(dnsServer, store, journal)
 
-	for _, node := range nodes {
-		cid := generateCid()
-		id := uuid.NewString()
+	for _, node := range conf.Nodes {
+		if node.Overlay != "" && node.Overlay != config.OverlayDisk && node.Overlay != config.OverlayRam {
+			return nil, fmt.Errorf("invalid overlay %q of node %s", node.Overlay, node.Name)
+		}
 
-		slog.Info("Generated CID", "node", node.Name, "cid", cid)
-		slog.Info("Generated ID", "node", node.Name, "id", id)
+		if node.Balloon != nil && (node.Balloon.AmountMib < 0 || node.Balloon.AmountMib >= node.Memory) {
+			return nil, fmt.Errorf("balloon of node %s must be smaller than its memory", node.Name)
+		}
 
-		tap, err := bridge.CreateTapDevice(id)
+		switch node.Restart {
+		case "", config.RestartNever, config.RestartOnFailure, config.RestartAlways:
+		default:
+			return nil, fmt.Errorf("invalid restart policy %q of node %s", node.Restart, node.Name)
+		}
+
+		if node.MaxRestarts < 0 {
+			return nil, fmt.Errorf("max_restarts of node %s must not be negative", node.Name)
+		}
+	}
+
+	if err := conf.CheckDependencies(); err != nil {
+		return nil, err
+	}
+
+	overlayDrivePaths, err := createOverlayDrives(s, idents, conf.Nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, node := range conf.Nodes {
+		if err := s.check(); err != nil {
+			return nil, err
+		}
+
+		userData, err := conf.NodeUserData(node)
 		if err != nil {
 			return nil, err
 		}
 
-		addr, err := ipamDb.AllocateFreeIPAddress(id)
+		drives, mounts, err := volumeDrives(node)
 		if err != nil {
 			return nil, err
 		}
-		slog.Info("Allocated free IP address", "node", node.Name, "addr", addr)
 
-		socketPath := config.SocketPath(id)
-		logFifoPath := config.LogFifoPath(id)
-		metricsFifoPath := config.MetricsFifoPath(id)
-		ipConfig, err := vm.NewMachineIpConfig(bridge.GetIPAddr(), addr, tap.Name)
+		extraDrives, extraMounts, err := imageDrives(node)
+		if err != nil {
+			return nil, err
+		}
+		drives = append(drives, extraDrives...)
+		mounts = append(mounts, extraMounts...)
+
+		if conf.Jailer != nil {
+			if err := vm.CheckJailedDrives(conf.Jailer, drives); err != nil {
+				return nil, fmt.Errorf("node %s: %w", node.Name, err)
+			}
+		}
+
+		cid := idents[i].cid
+		id := idents[i].id
+
+		slog.Info("Using CID", "node", node.Name, "cid", cid)
+		slog.Info("Using ID", "node", node.Name, "id", id)
+
+		tap, err := bridge.CreateTapDevice(id)
+		if err != nil {
+			return nil, err
+		}
+		s.onUndo("tap "+tap.Name, func() error {
+			return bridge.DeleteTapDevice(tap)
+		})
+
+		addr := idents[i].addr
+		if addr == "" {
+			addr, err = ipamDb.AllocateFreeIPAddress(id)
+		} else {
+			err = ipamDb.AllocateIPAddress(addr, id)
+		}
 		if err != nil {
 			return nil, err
 		}
+		leased := addr
+		s.onUndo("IP address "+addr, func() error {
+			return ipamDb.ReleaseIPAddress(leased)
+		})
+		slog.Info("Allocated IP address", "node", node.Name, "addr", addr)
 
-		overlayDrivePath, err := createOverlayDrive(id, node.Disk)
+		nameservers, searchDomains := resolv.guest(node)
+
+		socketPath := config.SocketPath(id)
+		logFifoPath := config.LogFifoPath(id)
+		metricsFifoPath := config.MetricsFifoPath(id)
+		ipConfig, err := vm.NewMachineIpConfig(bridge.GetIPAddr(), addr, tap.Name, nameservers)
 		if err != nil {
 			return nil, err
 		}
@@ -136,8 +362,12 @@ func createMachineGroup(ctx context.Context, nodes []config.Node, bridge *networ
 		if err != nil {
 			return nil, err
 		}
+		s.onUndo("stdio "+stdio.Name(), func() error {
+			stdio.Close()
+			return os.Remove(stdio.Name())
+		})
 
-		machine, err := vm.CreateMachine(ctx, vm.MachineOptions{
+		err = mg.AddMachine(ctx, vm.MachineOptions{
 			Id:                    id,
 			RootFsPath:            node.RootFsPath,
 			KernelImagePath:       kernelPath,
@@ -146,29 +376,113 @@ func createMachineGroup(ctx context.Context, nodes []config.Node, bridge *networ
 			InstanceFifoLogWriter: fifoLogWriter,
 			Stdio:                 stdio,
 			MetricsFifoPath:       metricsFifoPath,
-			OverlayDrivePath:      overlayDrivePath,
+			OverlayDrivePath:      overlayDrivePaths[i],
 			VmmLogPath:            config.VmmLogPath,
 			VsockPath:             config.VsockPath(node.Name),
 			Cid:                   cid,
 			Vcpu:                  node.Vcpu,
 			Memory:                node.Memory,
 			IpConfig:              ipConfig,
+			RateLimits:            node.RateLimits,
+			Drives:                drives,
+			Balloon:               node.Balloon,
+			Jailer:                conf.Jailer,
+			Binaries:              bins,
+			SnapshotMemPath:       idents[i].snapshotMemPath,
+			SnapshotStatePath:     idents[i].snapshotStatePath,
+		}, node.Name, vm.GuestConfig{
+			Nameservers:   nameservers,
+			SearchDomains: searchDomains,
+			Metadata:      conf.NodeMetadata(node),
+			UserData:      userData,
+			Mounts:        mounts,
+		}, vm.BootConfig{
+			Probe:       node.Ready,
+			DependsOn:   node.DependsOn,
+			Restart:     node.Restart,
+			MaxRestarts: node.MaxRestarts,
 		})
 		if err != nil {
 			return nil, err
 		}
 
-		mg.AddMachine(machine, node.Name, cid)
+		nodeConfig, err := json.Marshal(node)
+		if err != nil {
+			return nil, err
+		}
+
+		err = store.Put(state.Machine{
+			Name:       node.Name,
+			VmId:       id,
+			SocketPath: socketPath,
+			VsockPath:  config.VsockPath(node.Name),
+			Tap:        tap.Name,
+			Ipv4:       addr,
+			Cid:        cid,
+			ConfigHash: node.Hash(),
+			Config:     string(nodeConfig),
+			State:      state.StateCreated,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to record machine %s: %w", node.Name, err)
+		}
+		name := node.Name
+		s.onUndo("state of "+name, func() error {
+			return store.Remove(name)
+		})
 		slog.Debug("Created and added the machine config to the machine group")
 	}
 
 	return mg, nil
 }
 
-func generateCid() uint32 {
-	randomCid := rand.Intn(991)
-	randomCid += 10
-	return uint32(randomCid)
+// identity distinguishes a machine on the host. New machines get a fresh identity while restored
+// machines reuse the one recorded in their snapshot, which their devices refer to.
+type identity struct {
+	id   string
+	cid  uint32 // 0 to allocate a free CID
+	addr string // Empty to allocate a free IP address
+
+	// Set for machines restored from a snapshot.
+	snapshotMemPath     string
+	snapshotStatePath   string
+	snapshotOverlayPath string
+}
+
+func newIdentities(nodes []config.Node) []identity {
+	idents := make([]identity, len(nodes))
+	for i, node := range nodes {
+		idents[i] = identity{
+			id:  uuid.NewString(),
+			cid: node.Cid,
+		}
+	}
+
+	return idents
+}
+
+// allocateCids reserves the CIDs of the identities in the CID pool of the host. Identities without
+// a CID get the one their node had before or a free one. CIDs of nodes that were removed from the
+// cluster are released.
+func allocateCids(store *state.Store, conf config.Config, idents []identity) error {
+	names := make([]string, len(conf.Nodes))
+	for i, node := range conf.Nodes {
+		names[i] = node.Name
+	}
+
+	if err := store.ReleaseCids(conf.ClusterName(), names); err != nil {
+		return fmt.Errorf("failed to release CIDs: %w", err)
+	}
+
+	for i, node := range conf.Nodes {
+		cid, err := store.AllocateCid(conf.ClusterName(), node.Name, idents[i].cid)
+		if err != nil {
+			return err
+		}
+		idents[i].cid = cid
+	}
+
+	return nil
 }
 
 func createVmmLogFile(vmmLogPath string) (*os.File, error) {
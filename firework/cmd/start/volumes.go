@@ -0,0 +1,95 @@
+package start
+
+import (
+	"fmt"
+
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/jlkiri/firework/internal/volume"
+)
+
+// checkVolumes ensures that every volume exists and is attached in a way that does not corrupt
+// its filesystem.
+func checkVolumes(nodes []config.Node) error {
+	if err := checkAttachments(nodes); err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		for _, vol := range node.Volumes {
+			v, err := volume.Get(vol.Name)
+			if err != nil {
+				return fmt.Errorf("node %s: %w", node.Name, err)
+			}
+
+			// The agent can only mount a filesystem.
+			if v.Format == volume.FormatRaw && vol.MountPath != "" {
+				return fmt.Errorf("node %s: raw volume %s cannot be mounted, remove its mount_path", node.Name, vol.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkAttachments ensures that a node attaches a volume only once, because its drive ID would
+// be used twice, and that a volume attached read-write is not attached to any other node.
+func checkAttachments(nodes []config.Node) error {
+	attached := make(map[string][]config.VolumeMount)
+	owners := make(map[string][]string)
+	for _, node := range nodes {
+		seen := make(map[string]bool, len(node.Volumes))
+		for _, vol := range node.Volumes {
+			if seen[vol.Name] {
+				return fmt.Errorf("node %s: volume %s is attached more than once", node.Name, vol.Name)
+			}
+			seen[vol.Name] = true
+
+			attached[vol.Name] = append(attached[vol.Name], vol)
+			owners[vol.Name] = append(owners[vol.Name], node.Name)
+		}
+	}
+
+	for name, mounts := range attached {
+		if len(mounts) < 2 {
+			continue
+		}
+
+		for _, mount := range mounts {
+			if !mount.ReadOnly {
+				return fmt.Errorf("volume %s is attached read-write to more than one node: %v", name, owners[name])
+			}
+		}
+	}
+
+	return nil
+}
+
+// volumeDrives resolves the volumes of a node to drives and the mounts the guest agent performs.
+func volumeDrives(node config.Node) ([]vm.Drive, []vm.Mount, error) {
+	drives := make([]vm.Drive, 0, len(node.Volumes))
+	mounts := make([]vm.Mount, 0, len(node.Volumes))
+	for _, vol := range node.Volumes {
+		v, err := volume.Get(vol.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		driveId := volume.DriveId(v.Name)
+		drives = append(drives, vm.Drive{
+			Id:         driveId,
+			PathOnHost: v.Path,
+			ReadOnly:   vol.ReadOnly,
+		})
+
+		if vol.MountPath != "" {
+			mounts = append(mounts, vm.Mount{
+				DriveId:  driveId,
+				Path:     vol.MountPath,
+				ReadOnly: vol.ReadOnly,
+			})
+		}
+	}
+
+	return drives, mounts, nil
+}
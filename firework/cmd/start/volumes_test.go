@@ -0,0 +1,67 @@
+package start
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jlkiri/firework/internal/config"
+)
+
+func volumes(name string, mounts ...config.VolumeMount) config.Node {
+	return config.Node{Name: name, Volumes: mounts}
+}
+
+func TestCheckAttachments(t *testing.T) {
+	ro := func(name string) config.VolumeMount { return config.VolumeMount{Name: name, ReadOnly: true} }
+	rw := func(name string) config.VolumeMount { return config.VolumeMount{Name: name} }
+
+	tests := []struct {
+		name    string
+		nodes   []config.Node
+		wantErr string
+	}{
+		{
+			name:  "no volumes",
+			nodes: []config.Node{volumes("a"), volumes("b")},
+		},
+		{
+			name:  "different volumes",
+			nodes: []config.Node{volumes("a", rw("x"), ro("y")), volumes("b", rw("z"))},
+		},
+		{
+			name:  "shared read-only",
+			nodes: []config.Node{volumes("a", ro("x")), volumes("b", ro("x"))},
+		},
+		{
+			name:    "shared read-write",
+			nodes:   []config.Node{volumes("a", rw("x")), volumes("b", ro("x"))},
+			wantErr: "volume x is attached read-write to more than one node: [a b]",
+		},
+		{
+			name:    "twice on a node read-only",
+			nodes:   []config.Node{volumes("a", ro("x"), ro("x"))},
+			wantErr: "node a: volume x is attached more than once",
+		},
+		{
+			name:    "twice on a node read-write",
+			nodes:   []config.Node{volumes("a", ro("x"), rw("x"))},
+			wantErr: "node a: volume x is attached more than once",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAttachments(tt.nodes)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,59 +2,164 @@ package status
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"strings"
-	"text/tabwriter"
+	"strconv"
+	"sync"
+	"time"
 
+	units "github.com/docker/go-units"
 	"github.com/firecracker-microvm/firecracker-go-sdk"
-	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/output"
+	"github.com/jlkiri/firework/internal/state"
 	"github.com/jlkiri/firework/internal/vm"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 func NewStatusCommand() *cobra.Command {
+	opts := output.Options{}
+	watch := false
+	interval := 2 * time.Second
+
 	statusCmd := &cobra.Command{
 		Use:   "status",
 		Short: "View status of running VMs",
 		Long:  `View status of running VMs`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runStatus()
+			if watch {
+				return runWatch(opts, interval)
+			}
+			return runStatus(opts)
 		},
 	}
 
+	output.AddFlags(statusCmd, &opts)
+	statusCmd.Flags().BoolVarP(&watch, "watch", "w", watch, "Redraw the table until interrupted, with state transitions and CPU and memory usage")
+	statusCmd.Flags().DurationVar(&interval, "interval", interval, "How often to refresh with --watch")
 	return statusCmd
 }
 
-type Table struct {
-	header []string
-	rows   [][]string
+// machineStatus is a row of firework status. A machine that could not be queried still has a row
+// with the fields from the state store, and Error says what failed.
+type machineStatus struct {
+	Name        string     `json:"name"`
+	VmId        string     `json:"vm_id"`
+	State       string     `json:"state"`
+	VmmState    string     `json:"vmm_state,omitempty"` // Running or Paused as reported by Firecracker
+	Ready       bool       `json:"ready"`
+	Ipv4        string     `json:"ipv4"`
+	Tap         string     `json:"tap"`
+	Cid         uint32     `json:"cid"`
+	Pid         int        `json:"pid,omitempty"`
+	Vcpu        int64      `json:"vcpu,omitempty"`
+	MemoryMib   int64      `json:"memory_mib,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	Uptime      string     `json:"uptime,omitempty"`
+	Restarts    int        `json:"restarts"`
+	OverlayPath string     `json:"overlay_path,omitempty"` // Empty for a ram overlay
+	VmmVersion  string     `json:"vmm_version,omitempty"`
+	Balloon     string     `json:"balloon,omitempty"`
+	GuestFree   string     `json:"guest_free,omitempty"`
+	Error       string     `json:"error,omitempty"`
 }
 
-func (t *Table) SetHeader(header []string) {
-	t.header = header
-}
+// balloonStatus returns the current size of the balloon of a machine and the free memory reported
+// by the guest. Statistics are only available if they were enabled at boot.
+func balloonStatus(ctx context.Context, m *firecracker.Machine) (string, string) {
+	stats, err := m.GetBalloonStats(ctx)
+	if err == nil {
+		return fmt.Sprintf("%d/%dMiB", *stats.ActualMib, *stats.TargetMib), units.BytesSize(float64(stats.FreeMemory))
+	}
+
+	balloon, err := m.GetBalloonConfig(ctx)
+	if err != nil {
+		return "", ""
+	}
 
-func (t *Table) AddRow(row []string) {
-	t.rows = append(t.rows, row)
+	return fmt.Sprintf("%dMiB", *balloon.AmountMib), ""
 }
 
-func (t *Table) Print() {
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, strings.Join(t.header, "\t"))
-	fmt.Fprintln(w, "\t\t\t")
+// queryStatus returns the status of a machine from its record in the state store and, if it is
+// running, from its API socket.
+func queryStatus(ctx context.Context, record state.Machine) machineStatus {
+	s := machineStatus{
+		Name:        record.Name,
+		VmId:        record.VmId,
+		State:       record.State,
+		Ready:       record.State == state.StateReady,
+		Ipv4:        record.Ipv4,
+		Tap:         record.Tap,
+		Cid:         record.Cid,
+		Pid:         record.Pid,
+		Restarts:    record.Restarts,
+		OverlayPath: vm.OverlayDrive(record.VmId),
+	}
+
+	if !record.Running() {
+		return s
+	}
+
+	startedAt := record.StartedAt
+	s.StartedAt = &startedAt
+	s.Uptime = time.Since(startedAt).Round(time.Second).String()
+
+	ctx, cancel := context.WithTimeout(ctx, vm.QueryTimeout)
+	defer cancel()
+
+	m, err := vm.Connect(ctx, record.VmId)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+
+	instance, err := m.DescribeInstanceInfo(ctx)
+	if err != nil {
+		s.Error = fmt.Sprintf("failed to describe instance: %s", err)
+		return s
+	}
+	s.VmmState = *instance.State
+	s.VmmVersion = *instance.VmmVersion
+
+	cfg, err := vm.ExportConfig(m)
+	if err != nil {
+		s.Error = fmt.Sprintf("failed to export config: %s", err)
+		return s
+	}
+	if mc := cfg.MachineConfig; mc != nil {
+		s.Vcpu = *mc.VcpuCount
+		s.MemoryMib = *mc.MemSizeMib
+	}
+
+	s.Balloon, s.GuestFree = balloonStatus(ctx, m)
+	return s
+}
 
-	for _, row := range t.rows {
-		str := strings.Join(row, "\t")
-		fmt.Fprintln(w, str)
+// queryStatuses queries all machines in parallel, so that a machine that does not answer only
+// delays the result by vm.QueryTimeout.
+func queryStatuses(ctx context.Context, records []state.Machine) []machineStatus {
+	statuses := make([]machineStatus, len(records))
+
+	var wg sync.WaitGroup
+	for i, record := range records {
+		i, record := i, record
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = queryStatus(ctx, record)
+		}()
 	}
 
-	w.Flush()
+	wg.Wait()
+	return statuses
 }
 
-func runStatus() error {
+func runStatus(opts output.Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
 	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0644)
 	if err != nil {
 		return err
@@ -63,53 +168,81 @@ func runStatus() error {
 	// Logger that logs to /dev/null to hide Firecracker binary output
 	logrus.SetOutput(devNull)
 
-	pidTablePath := config.PidTablePath()
-	pidTableFile, err := os.ReadFile(pidTablePath)
-	if err != nil {
+	records, err := vm.ReadMachines()
+	if err != nil && !errors.Is(err, state.ErrNoCluster) {
 		return err
 	}
 
-	var pidTable vm.PidTable
-	if err := json.Unmarshal(pidTableFile, &pidTable); err != nil {
-		return err
-	}
+	statuses := queryStatuses(context.Background(), records)
 
-	ctx := context.Background()
+	return opts.Print(os.Stdout, statuses, func(wide bool) output.Table {
+		return statusTable(statuses, wide)
+	})
+}
 
-	table := &Table{}
-	table.SetHeader([]string{"VMID", "NAME", "IPv4", "STATUS"})
+// statusTable renders statuses with the columns of firework status.
+func statusTable(statuses []machineStatus, wide bool) output.Table {
+	header := []string{"VMID", "NAME", "IPv4", "STATE", "READY", "UPTIME", "RESTARTS"}
+	if wide {
+		header = append(header, "VCPU", "MEMORY", "CID", "TAP", "PID", "OVERLAY", "VMM VERSION", "BALLOON", "GUEST FREE")
+	}
 
-	for name, entry := range pidTable {
-		socketPath := config.SocketPath(entry.VmId)
-		if _, err := os.Stat(socketPath); os.IsNotExist(err) {
-			continue
+	table := output.Table{Header: header}
+	for _, s := range statuses {
+		row := []string{s.VmId, s.Name, s.Ipv4, displayState(s), yesNo(s.Ready), orDash(s.Uptime), strconv.Itoa(s.Restarts)}
+		if wide {
+			row = append(row,
+				orDash(formatInt(s.Vcpu)),
+				orDash(formatMib(s.MemoryMib)),
+				strconv.FormatUint(uint64(s.Cid), 10),
+				s.Tap,
+				orDash(formatInt(int64(s.Pid))),
+				orDash(s.OverlayPath),
+				orDash(s.VmmVersion),
+				orDash(s.Balloon),
+				orDash(s.GuestFree),
+			)
 		}
+		table.Rows = append(table.Rows, row)
+	}
 
-		m, err := firecracker.NewMachine(ctx, firecracker.Config{
-			SocketPath: socketPath,
-		}, firecracker.WithLogger(logrus.NewEntry(logrus.StandardLogger())))
-		if err != nil {
-			return err
-		}
+	return table
+}
 
-		instance, err := m.DescribeInstanceInfo(ctx)
-		if err != nil {
-			return err
-		}
+func displayState(s machineStatus) string {
+	if s.Error != "" {
+		return "error: " + s.Error
+	}
+	if s.VmmState == "Paused" {
+		return "paused"
+	}
+	return s.State
+}
 
-		type Metadata struct {
-			IPv4 string `json:"ipv4"`
-		}
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
 
-		var metadata Metadata
-		err = m.GetMetadata(ctx, &metadata)
-		if err != nil {
-			return err
-		}
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
 
-		table.AddRow([]string{entry.VmId, name, metadata.IPv4, *instance.State})
+func formatInt(n int64) string {
+	if n == 0 {
+		return ""
 	}
+	return strconv.FormatInt(n, 10)
+}
 
-	table.Print()
-	return nil
+func formatMib(mib int64) string {
+	if mib == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dMiB", mib)
 }
@@ -0,0 +1,217 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/jlkiri/firework/internal/output"
+	"github.com/jlkiri/firework/internal/state"
+	"github.com/jlkiri/firework/internal/vm"
+	"golang.org/x/term"
+)
+
+// maxTransitions is the number of recent state transitions shown below the table.
+const maxTransitions = 10
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc, which is 100 on all supported architectures.
+const clockTicks = 100
+
+type transition struct {
+	at       time.Time
+	name     string
+	from, to string
+}
+
+func (t transition) String() string {
+	if t.from == "" {
+		return fmt.Sprintf("%s   %s %s", t.at.Format(time.TimeOnly), t.name, t.to)
+	}
+	return fmt.Sprintf("%s   %s %s -> %s", t.at.Format(time.TimeOnly), t.name, t.from, t.to)
+}
+
+// cpuSample is the CPU time of a process at a point in time.
+type cpuSample struct {
+	ticks uint64
+	at    time.Time
+}
+
+// watcher polls the state store and the API sockets and keeps what changed between polls.
+type watcher struct {
+	interval time.Duration
+	wide     bool
+	tty      bool
+
+	states      map[string]string // Displayed state of every machine by name
+	cpu         map[int]cpuSample // Last CPU sample of every Firecracker process by PID
+	transitions []transition
+}
+
+func runWatch(opts output.Options, interval time.Duration) error {
+	if opts.Format != output.FormatTable && opts.Format != output.FormatWide {
+		return fmt.Errorf("--watch only supports table output")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w := &watcher{
+		interval: interval,
+		wide:     opts.Format == output.FormatWide,
+		tty:      term.IsTerminal(int(os.Stdout.Fd())),
+		states:   make(map[string]string),
+		cpu:      make(map[int]cpuSample),
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.poll(ctx); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *watcher) poll(ctx context.Context) error {
+	records, err := vm.ReadMachines()
+	if err != nil && !errors.Is(err, state.ErrNoCluster) {
+		return err
+	}
+
+	// A machine that does not answer must not hold up the redraw for longer than an interval.
+	queryCtx, cancel := context.WithTimeout(ctx, w.interval)
+	statuses := queryStatuses(queryCtx, records)
+	cancel()
+
+	now := time.Now()
+	cpu := make([]string, len(records))
+	rss := make([]string, len(records))
+	changed := make([]transition, 0)
+	seen := make(map[string]bool, len(records))
+
+	for i, record := range records {
+		seen[record.Name] = true
+
+		cpu[i], rss[i] = w.usage(record.Pid, now)
+
+		current := displayState(statuses[i])
+		if previous, ok := w.states[record.Name]; !ok || previous != current {
+			changed = append(changed, transition{now, record.Name, previous, current})
+		}
+		w.states[record.Name] = current
+	}
+
+	// Machines disappear from the state store when the cluster is stopped or started again.
+	for name, previous := range w.states {
+		if !seen[name] {
+			changed = append(changed, transition{now, name, previous, "removed"})
+			delete(w.states, name)
+		}
+	}
+
+	if !w.tty {
+		// Only print what changed so that the output can be followed in a log.
+		for _, t := range changed {
+			fmt.Println(t)
+		}
+		return nil
+	}
+
+	w.transitions = append(w.transitions, changed...)
+	if len(w.transitions) > maxTransitions {
+		w.transitions = w.transitions[len(w.transitions)-maxTransitions:]
+	}
+
+	table := statusTable(statuses, w.wide)
+	table.Header = append(table.Header, "CPU", "RSS")
+	for i := range table.Rows {
+		table.Rows[i] = append(table.Rows[i], cpu[i], rss[i])
+	}
+
+	// Move the cursor home and clear the screen before redrawing.
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("Every %s: firework status   %s\n\n", w.interval, now.Format(time.TimeOnly))
+	if err := table.Print(os.Stdout); err != nil {
+		return err
+	}
+
+	if len(w.transitions) > 0 {
+		fmt.Println()
+		for _, t := range w.transitions {
+			fmt.Println(t)
+		}
+	}
+
+	return nil
+}
+
+// usage returns the CPU usage since the last poll and the resident memory of a Firecracker process.
+func (w *watcher) usage(pid int, now time.Time) (string, string) {
+	if pid == 0 {
+		return "-", "-"
+	}
+
+	ticks, rssBytes, err := readProc(pid)
+	if err != nil {
+		delete(w.cpu, pid)
+		return "-", "-"
+	}
+
+	cpu := "-"
+	if prev, ok := w.cpu[pid]; ok && ticks >= prev.ticks {
+		elapsed := now.Sub(prev.at).Seconds()
+		if elapsed > 0 {
+			cpu = fmt.Sprintf("%.1f%%", float64(ticks-prev.ticks)/clockTicks/elapsed*100)
+		}
+	}
+	w.cpu[pid] = cpuSample{ticks, now}
+
+	return cpu, units.BytesSize(float64(rssBytes))
+}
+
+// readProc returns the CPU time in clock ticks and the resident set size in bytes of a process.
+func readProc(pid int) (uint64, int64, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The command name in parentheses can contain spaces, so fields are counted after it.
+	// utime and stime are fields 14 and 15, rss in pages is field 24.
+	s := string(stat)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rssPages, err := strconv.ParseInt(fields[21], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return utime + stime, rssPages * int64(os.Getpagesize()), nil
+}
@@ -2,15 +2,19 @@ package stop
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/jlkiri/firework/internal/config"
 	"github.com/jlkiri/firework/internal/network"
+	"github.com/jlkiri/firework/internal/state"
 	"github.com/jlkiri/firework/internal/vm"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -39,49 +43,171 @@ func cleanup() {
 		log.Fatalf("Failed to cleanup network: %v", err)
 	}
 
-	if err := os.Remove(filepath.Join(config.MiscDir, "ips.db")); err != nil {
-		log.Println("Failed to remove ips.db:", err)
+	// Keep the database for the CID pool and forget the machines.
+	if store, err := state.OpenExisting(config.DbPath); err == nil {
+		if err := store.Reset(); err != nil {
+			log.Println("Failed to reset state:", err)
+		}
+		store.Close()
 	}
 
 	if err := os.RemoveAll(config.VmDataDir); err != nil {
 		log.Println("Failed to remove vm data dir:", err)
 	}
+
+	if err := os.RemoveAll(config.JailerDir); err != nil {
+		log.Println("Failed to remove jailer dir:", err)
+	}
 }
 
-func runStop() error {
-	defer cleanup()
+// supervisorTimeout is how long stop waits for firework start to shut its machines down, which
+// kills machines that did not shut down after vm.ShutdownTimeout.
+const supervisorTimeout = vm.ShutdownTimeout + 10*time.Second
 
-	pidTablePath := config.PidTablePath()
-	pidTableFile, err := os.ReadFile(pidTablePath)
+// stopSupervisor asks the firework process that runs the machines to shut them down and waits until
+// it exited. Otherwise it would restart machines with a restart policy while they are stopped.
+func stopSupervisor() error {
+	store, err := state.OpenExisting(config.DbPath)
 	if err != nil {
 		return err
 	}
+	defer store.Close()
 
-	var pidTable vm.PidTable
-	if err := json.Unmarshal(pidTableFile, &pidTable); err != nil {
+	pid, err := store.Supervisor()
+	if err != nil {
+		return fmt.Errorf("failed to read supervisor: %w", err)
+	}
+	if pid == 0 {
+		return nil
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
 		return err
 	}
 
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		if errors.Is(err, os.ErrProcessDone) {
+			return nil
+		}
+		return err
+	}
+
+	deadline := time.Now().Add(supervisorTimeout)
+	for time.Now().Before(deadline) {
+		if err := proc.Signal(syscall.Signal(0)); err != nil {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	return fmt.Errorf("firework start (pid %d) did not exit within %s", pid, supervisorTimeout)
+}
+
+func runStop() error {
+	defer cleanup()
+
 	// Logger that logs to /dev/null to hide Firecracker binary output
 	logrus.SetOutput(io.Discard)
 
-	for _, entry := range pidTable {
-		socketPath := config.SocketPath(entry.VmId)
-		if _, err := os.Stat(socketPath); os.IsNotExist(err) {
-			continue
+	if err := stopSupervisor(); err != nil {
+		if errors.Is(err, state.ErrNoCluster) {
+			return err
 		}
+		log.Println("Failed to stop firework start, shutting down machines directly:", err)
+	}
 
-		m, err := firecracker.NewMachine(context.TODO(), firecracker.Config{
-			SocketPath: socketPath,
-		}, firecracker.WithLogger(logrus.NewEntry(logrus.StandardLogger())))
-		if err != nil {
-			return err
+	// Machines are still running if firework start was killed or did not exit in time.
+	records, err := vm.ReadMachines()
+	if err != nil {
+		return err
+	}
+
+	pids := make([]int, 0, len(records))
+	for _, record := range records {
+		if !record.Running() {
+			continue
 		}
 
-		if err := m.Shutdown(context.TODO()); err != nil {
-			return err
+		if err := shutdownMachine(record); err != nil {
+			log.Printf("Failed to shut down %s: %v", record.Name, err)
 		}
+		pids = append(pids, record.Pid)
 	}
 
+	// cleanup removes the files of the machines, so none of them may outlive stop.
+	killAfter(pids, vm.ShutdownTimeout)
 	return nil
 }
+
+// shutdownMachine asks a machine to shut down through its API socket. It is resumed first
+// because a paused guest does not react to CtrlAltDel.
+func shutdownMachine(record state.Machine) error {
+	socketPath := record.SocketPath
+	if _, err := os.Stat(socketPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	m, err := firecracker.NewMachine(context.TODO(), firecracker.Config{
+		SocketPath: socketPath,
+	}, firecracker.WithLogger(logrus.NewEntry(logrus.StandardLogger())))
+	if err != nil {
+		return err
+	}
+
+	// Fails if the machine is not paused, which is fine.
+	_ = m.ResumeVM(context.TODO())
+
+	return m.Shutdown(context.TODO())
+}
+
+// killAfter waits until the Firecracker processes with the given PIDs exited and kills the ones
+// that are still running after timeout.
+func killAfter(pids []int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		running := make([]int, 0, len(pids))
+		for _, pid := range pids {
+			if isFirecracker(pid) {
+				running = append(running, pid)
+			}
+		}
+		pids = running
+
+		if len(pids) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	for _, pid := range pids {
+		log.Printf("Firecracker (pid %d) did not shut down within %s, killing it", pid, timeout)
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Printf("Failed to kill Firecracker (pid %d): %v", pid, err)
+		}
+	}
+}
+
+// isFirecracker reports whether the process with the given PID is a running Firecracker, to not
+// kill an unrelated process that reused the PID.
+func isFirecracker(pid int) bool {
+	if pid == 0 {
+		return false
+	}
+
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return false
+	}
+
+	// Zombies still have a comm but are gone for our purposes.
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err == nil {
+		s := string(stat)
+		if fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:]); len(fields) > 0 && fields[0] == "Z" {
+			return false
+		}
+	}
+
+	return strings.HasPrefix(strings.TrimSpace(string(comm)), "firecracker")
+}
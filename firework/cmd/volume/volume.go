@@ -0,0 +1,171 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	units "github.com/docker/go-units"
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/output"
+	"github.com/jlkiri/firework/internal/state"
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/jlkiri/firework/internal/volume"
+	"github.com/spf13/cobra"
+)
+
+func NewVolumeCommand() *cobra.Command {
+	volumeCmd := &cobra.Command{
+		Use:   "volume",
+		Short: "Manage persistent volumes",
+		Long:  `Manage persistent volumes that can be attached to nodes and survive cluster restarts`,
+	}
+
+	volumeCmd.AddCommand(newCreateCommand())
+	volumeCmd.AddCommand(newListCommand())
+	volumeCmd.AddCommand(newRemoveCommand())
+
+	return volumeCmd
+}
+
+func newCreateCommand() *cobra.Command {
+	size := "1G"
+	format := volume.FormatExt4
+
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a volume",
+		Long:  `Create a sparse volume image`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCreate(args[0], size, format)
+		},
+	}
+
+	createCmd.Flags().StringVarP(&size, "size", "s", size, "Capacity of the volume, e.g. 512M or 10G")
+	createCmd.Flags().StringVarP(&format, "format", "f", format, "Format of the volume: ext4 or raw")
+	return createCmd
+}
+
+func newListCommand() *cobra.Command {
+	opts := output.Options{}
+
+	listCmd := &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List volumes",
+		Long:    `List volumes`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runList(opts)
+		},
+	}
+
+	output.AddFlags(listCmd, &opts)
+	return listCmd
+}
+
+func newRemoveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:     "rm <name>...",
+		Aliases: []string{"remove"},
+		Short:   "Remove volumes",
+		Long:    `Remove volumes and all data stored in them`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRemove(args)
+		},
+	}
+}
+
+func runCreate(name, size, format string) error {
+	bytes, err := units.RAMInBytes(size)
+	if err != nil {
+		return fmt.Errorf("invalid size %s: %w", size, err)
+	}
+
+	v, err := volume.Create(name, bytes, format)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(v.Name)
+	return nil
+}
+
+func runList(opts output.Options) error {
+	volumes, err := volume.List()
+	if err != nil {
+		return err
+	}
+
+	return opts.Print(os.Stdout, volumes, func(wide bool) output.Table {
+		table := output.Table{Header: []string{"NAME", "FORMAT", "SIZE", "PATH"}}
+		for _, v := range volumes {
+			table.Rows = append(table.Rows, []string{v.Name, v.Format, units.BytesSize(float64(v.Size)), v.Path})
+		}
+		return table
+	})
+}
+
+// attachedVolumes returns the nodes of the running cluster by the volumes attached to them. The
+// state store only knows the machines, so their volumes are looked up in config.json.
+func attachedVolumes() (map[string][]string, error) {
+	records, err := vm.ReadMachines()
+	if errors.Is(err, state.ErrNoCluster) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	running := make(map[string]bool, len(records))
+	for _, record := range records {
+		if record.State != state.StateExited && record.State != state.StateFailed {
+			running[record.Name] = true
+		}
+	}
+	if len(running) == 0 {
+		return nil, nil
+	}
+
+	conf, err := config.Read("config.json")
+	if err != nil {
+		return nil, fmt.Errorf("cannot check whether volumes are attached to the running cluster: %w", err)
+	}
+
+	attached := make(map[string][]string)
+	for _, node := range conf.Nodes {
+		if !running[node.Name] {
+			continue
+		}
+		for _, vol := range node.Volumes {
+			attached[vol.Name] = append(attached[vol.Name], node.Name)
+		}
+	}
+
+	return attached, nil
+}
+
+func runRemove(names []string) error {
+	attached, err := attachedVolumes()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if nodes := attached[name]; len(nodes) > 0 {
+			return fmt.Errorf("volume %s is attached to %v of the running cluster, stop it first", name, nodes)
+		}
+	}
+
+	for _, name := range names {
+		if err := volume.Remove(name); err != nil {
+			return err
+		}
+
+		fmt.Println(name)
+	}
+
+	return nil
+}
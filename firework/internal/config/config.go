@@ -1,28 +1,163 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 )
 
+// TokenBucket mirrors Firecracker's token bucket. Size tokens are refilled every
+// RefillTimeMs milliseconds. A zero Size disables the bucket.
+type TokenBucket struct {
+	Size         int64 `json:"size"`
+	RefillTimeMs int64 `json:"refill_time_ms"`
+	OneTimeBurst int64 `json:"one_time_burst,omitempty"`
+}
+
+// RateLimiter limits bandwidth (bytes) and operations (packets or disk requests).
+type RateLimiter struct {
+	Bandwidth *TokenBucket `json:"bandwidth,omitempty"`
+	Ops       *TokenBucket `json:"ops,omitempty"`
+}
+
+type RateLimits struct {
+	NetworkIn  *RateLimiter `json:"network_in,omitempty"`
+	NetworkOut *RateLimiter `json:"network_out,omitempty"`
+	// Disk limits the drive of the root filesystem, i.e. the overlay drive or, with a ram overlay,
+	// the root drive. Volumes and drives are not limited.
+	Disk *RateLimiter `json:"disk,omitempty"`
+}
+
+// Writable layers of the root filesystem. A disk overlay is an ext4 file of Node.Disk capacity
+// while a ram overlay is a tmpfs inside the guest that is limited by its memory.
+const (
+	OverlayDisk = "disk"
+	OverlayRam  = "ram"
+)
+
+// VolumeMount attaches a persistent volume to a node. The guest agent mounts it at MountPath if it is set.
+type VolumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mount_path"`
+	ReadOnly  bool   `json:"read_only"`
+}
+
+// Drive attaches an existing disk image, e.g. a squashfs of test fixtures, to a node. Id must contain
+// only letters, digits and underscores. The guest agent mounts the drive at MountPath if it is set.
+type Drive struct {
+	Id        string `json:"id"`
+	Path      string `json:"path"`
+	ReadOnly  bool   `json:"read_only"`
+	MountPath string `json:"mount_path"`
+}
+
+// Balloon adds a memory balloon device to a node. The balloon starts inflated by AmountMib, which the
+// guest cannot use, and can be resized at runtime to reclaim idle memory of the guest.
+type Balloon struct {
+	AmountMib    int64 `json:"amount_mib"`
+	DeflateOnOom bool  `json:"deflate_on_oom"`
+	// Interval of guest memory statistics in seconds. 0 disables statistics.
+	StatsIntervalS int64 `json:"stats_interval_s"`
+}
+
+// Probe checks whether a node is ready after its agent answered. All set checks must succeed.
+type Probe struct {
+	// TcpPort is a port of the node that must accept connections.
+	TcpPort int `json:"tcp_port"`
+	// Exec is a shell command that the agent runs in the node and that must exit with 0.
+	Exec string `json:"exec"`
+}
+
+// Conditions of a dependency on another node.
+const (
+	ConditionStarted = "started"
+	ConditionReady   = "ready"
+)
+
+// Dependency delays the start of a node until another node has started or, by default, is ready.
+type Dependency struct {
+	Name      string `json:"name"`
+	Condition string `json:"condition"`
+}
+
+// Restart policies of a node. A node is restarted in place, keeping its IP address, overlay drive and CID.
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
 type Node struct {
-	Name       string `json:"name"`
-	Vcpu       int64  `json:"vcpu"`
-	Memory     int64  `json:"memory"`
-	RootFsPath string `json:"rootfs_path"`
-	Disk       int64  `json:"disk"`
+	Name       string        `json:"name"`
+	Vcpu       int64         `json:"vcpu"`
+	Memory     int64         `json:"memory"`
+	RootFsPath string        `json:"rootfs_path"`
+	Disk       int64         `json:"disk"`
+	Overlay    string        `json:"overlay"`
+	RateLimits RateLimits    `json:"rate_limits"`
+	Volumes    []VolumeMount `json:"volumes"`
+	Drives     []Drive       `json:"drives"`
+	Balloon    *Balloon      `json:"balloon"`
+	Ready      *Probe        `json:"ready"`
+	DependsOn  []Dependency  `json:"depends_on"`
+	// Cid is the vsock CID of the node. A free CID is allocated if it is 0.
+	Cid uint32 `json:"cid"`
+	// Restart is one of the restart policies and defaults to RestartNever. MaxRestarts of 0 is unlimited.
+	Restart     string `json:"restart"`
+	MaxRestarts int    `json:"max_restarts"`
+	// Nameservers and SearchDomains override the cluster-wide settings for this node.
+	Nameservers   []string `json:"nameservers"`
+	SearchDomains []string `json:"search_domains"`
+	// Metadata is merged over the cluster metadata. UserData and UserDataFile replace the cluster ones.
+	Metadata     map[string]interface{} `json:"metadata"`
+	UserData     string                 `json:"user_data"`
+	UserDataFile string                 `json:"user_data_file"`
+}
+
+// Jailer runs Firecracker through the jailer in a chroot, cgroup and optionally a network
+// namespace as an unprivileged user instead of as root.
+type Jailer struct {
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+	// CgroupVersion is "1" or "2". The jailer defaults to "1".
+	CgroupVersion string `json:"cgroup_version"`
+	// Cgroups are passed to the jailer as --cgroup, e.g. "cpu.max=50000 100000".
+	Cgroups []string `json:"cgroups"`
+	// NetNS is the path of a network namespace to join, e.g. /var/run/netns/firework.
+	NetNS string `json:"netns"`
 }
 
+const DefaultClusterName = "default"
+
 type Config struct {
+	Name       string `json:"name"`
 	Nodes      []Node `json:"nodes"`
 	SubnetCidr string `json:"subnet_cidr"`
 	Gateway    string `json:"gateway"`
+	// Upstream nameservers and search domains of the cluster. Both default to the host's /etc/resolv.conf.
+	Nameservers   []string `json:"nameservers"`
+	SearchDomains []string `json:"search_domains"`
+	// Free-form metadata and a user-data script that are published to every node through MMDS.
+	// UserDataFile is a path to the script relative to the working directory.
+	Metadata     map[string]interface{} `json:"metadata"`
+	UserData     string                 `json:"user_data"`
+	UserDataFile string                 `json:"user_data_file"`
+	// Jailer enables jailer mode for all nodes if set.
+	Jailer *Jailer `json:"jailer"`
+	// Paths of the Firecracker and jailer binaries. Both are looked up in $PATH if not set.
+	FirecrackerBin string `json:"firecracker_bin"`
+	JailerBin      string `json:"jailer_bin"`
 }
 
 func Read(path string) (Config, error) {
-	wd, _ := os.Getwd()
-	absPath := filepath.Join(wd, path)
+	absPath, err := AbsPath(path)
+	if err != nil {
+		return Config{}, err
+	}
+
 	file, err := os.ReadFile(absPath)
 	if err != nil {
 		return Config{}, err
@@ -36,3 +171,77 @@ func Read(path string) (Config, error) {
 
 	return config, nil
 }
+
+// ClusterName returns the name of the cluster or DefaultClusterName if it is not set.
+func (c Config) ClusterName() string {
+	if c.Name == "" {
+		return DefaultClusterName
+	}
+	return c.Name
+}
+
+// Hash identifies the configuration of a node, so that a machine can be compared with the config
+// it was created from.
+func (n Node) Hash() string {
+	b, _ := json.Marshal(n)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// NodeMetadata returns the cluster metadata with the node metadata merged over it.
+func (c Config) NodeMetadata(n Node) map[string]interface{} {
+	metadata := make(map[string]interface{}, len(c.Metadata)+len(n.Metadata))
+	for k, v := range c.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range n.Metadata {
+		metadata[k] = v
+	}
+
+	return metadata
+}
+
+// NodeUserData returns the user-data script of a node, falling back to the cluster user-data.
+func (c Config) NodeUserData(n Node) (string, error) {
+	if n.UserData != "" || n.UserDataFile != "" {
+		return readUserData(n.UserData, n.UserDataFile)
+	}
+
+	return readUserData(c.UserData, c.UserDataFile)
+}
+
+func readUserData(userData, userDataFile string) (string, error) {
+	if userData != "" && userDataFile != "" {
+		return "", fmt.Errorf("only one of user_data and user_data_file can be set")
+	}
+
+	if userDataFile == "" {
+		return userData, nil
+	}
+
+	path, err := AbsPath(userDataFile)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read user data: %w", err)
+	}
+
+	return string(file), nil
+}
+
+// AbsPath resolves a path from the config relative to the working directory.
+func AbsPath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+
+	return filepath.Join(wd, path), nil
+}
@@ -1,3 +1,6 @@
 package config
 
 const VSOCK_LISTENER_PORT = 10000
+
+// Port of the agent that answers readiness checks and runs readiness probes.
+const VSOCK_READY_PORT = 10001
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CheckDependencies validates the dependencies between nodes and reports the first cycle it finds.
+func (c Config) CheckDependencies() error {
+	nodes := make(map[string]Node, len(c.Nodes))
+	for _, node := range c.Nodes {
+		nodes[node.Name] = node
+	}
+
+	for _, node := range c.Nodes {
+		for _, dep := range node.DependsOn {
+			if _, ok := nodes[dep.Name]; !ok {
+				return fmt.Errorf("node %s depends on unknown node %s", node.Name, dep.Name)
+			}
+
+			if dep.Condition != "" && dep.Condition != ConditionStarted && dep.Condition != ConditionReady {
+				return fmt.Errorf("invalid condition %q of the dependency of node %s on %s", dep.Condition, node.Name, dep.Name)
+			}
+		}
+	}
+
+	// Depth-first search that keeps the current path to report the cycle.
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(nodes))
+	path := []string{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			start := 0
+			for path[start] != name {
+				start++
+			}
+			cycle := append(path[start:], name)
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range nodes[name].DependsOn {
+			if err := visit(dep.Name); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+
+		return nil
+	}
+
+	for _, node := range c.Nodes {
+		if err := visit(node.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
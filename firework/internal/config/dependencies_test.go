@@ -0,0 +1,86 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func node(name string, deps ...string) Node {
+	n := Node{Name: name}
+	for _, dep := range deps {
+		n.DependsOn = append(n.DependsOn, Dependency{Name: dep})
+	}
+	return n
+}
+
+func TestCheckDependencies(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodes   []Node
+		wantErr string
+	}{
+		{
+			name:  "no dependencies",
+			nodes: []Node{node("a"), node("b")},
+		},
+		{
+			name:  "chain",
+			nodes: []Node{node("c", "b"), node("b", "a"), node("a")},
+		},
+		{
+			name:  "diamond",
+			nodes: []Node{node("a"), node("b", "a"), node("c", "a"), node("d", "b", "c")},
+		},
+		{
+			name: "conditions",
+			nodes: []Node{node("a"), {
+				Name: "b",
+				DependsOn: []Dependency{
+					{Name: "a", Condition: ConditionStarted},
+					{Name: "a", Condition: ConditionReady},
+				},
+			}},
+		},
+		{
+			name:    "unknown node",
+			nodes:   []Node{node("a", "x")},
+			wantErr: "node a depends on unknown node x",
+		},
+		{
+			name:    "invalid condition",
+			nodes:   []Node{node("a"), {Name: "b", DependsOn: []Dependency{{Name: "a", Condition: "healthy"}}}},
+			wantErr: `invalid condition "healthy"`,
+		},
+		{
+			name:    "self",
+			nodes:   []Node{node("a", "a")},
+			wantErr: "dependency cycle: a -> a",
+		},
+		{
+			name:    "two nodes",
+			nodes:   []Node{node("a", "b"), node("b", "a")},
+			wantErr: "dependency cycle: a -> b -> a",
+		},
+		{
+			name:    "cycle behind a chain",
+			nodes:   []Node{node("a", "b"), node("b", "c"), node("c", "d"), node("d", "b")},
+			wantErr: "dependency cycle: b -> c -> d -> b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Config{Nodes: tt.nodes}.CheckDependencies()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
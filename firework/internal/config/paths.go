@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 )
@@ -11,12 +12,16 @@ const SquashFsUrl = "https://pub-1a5aeef625fc45b4a4bef89ee141047f.r2.dev/rootfs.
 const DataDir = "/var/lib/firework"
 const CacheDir = "/var/lib/firework/cache"
 const VmDataDir = "/var/lib/firework/vm"
+const VolumesDir = "/var/lib/firework/volumes"
+const SnapshotsDir = "/var/lib/firework/snapshots"
+const JailerDir = "/var/lib/firework/jailer"
 
 const KernelDir = "/var/lib/firework/cache/kernel"
 const RootFsDir = "/var/lib/firework/cache/rootfs"
 const MiscDir = "/var/lib/firework/misc"
 const DbPath = "/var/lib/firework/misc/ips.db"
 const VmmLogPath = "/var/lib/firework/vmm.log"
+const EventsPath = "/var/lib/firework/events.jsonl"
 
 func RootFsPath() string {
 	envRootFsPath := os.Getenv("ROOTFS_PATH")
@@ -50,8 +55,10 @@ func OverlayDrivePath(vmId string) string {
 	return filepath.Join(VmDataDir, vmId+"-overlay.ext4")
 }
 
-func PidTablePath() string {
-	return filepath.Join(MiscDir, "pid_table.json")
+// OverlayTemplatePath is the path of a formatted overlay image of the given capacity in GiB
+// that overlay drives are cloned from.
+func OverlayTemplatePath(capacity int64) string {
+	return filepath.Join(CacheDir, "overlay", fmt.Sprintf("overlay-%dG.ext4", capacity))
 }
 
 func StdioPath(vmId string) string {
@@ -0,0 +1,66 @@
+package dns
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+type ResolvConf struct {
+	Nameservers   []string
+	SearchDomains []string
+}
+
+// ReadHostResolvConf returns the nameservers and search domains the host is configured to use.
+func ReadHostResolvConf() (ResolvConf, error) {
+	f, err := os.Open(resolvConfPath)
+	if err != nil {
+		return ResolvConf{}, err
+	}
+	defer f.Close()
+
+	rc := ResolvConf{
+		Nameservers:   make([]string, 0),
+		SearchDomains: make([]string, 0),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			rc.Nameservers = append(rc.Nameservers, fields[1])
+		case "search", "domain":
+			// The last search or domain line wins.
+			rc.SearchDomains = fields[1:]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return ResolvConf{}, err
+	}
+
+	return rc, nil
+}
+
+// RoutableNameservers filters out loopback nameservers (e.g. systemd-resolved's 127.0.0.53)
+// that are only reachable from the host itself.
+func RoutableNameservers(nameservers []string) []string {
+	routable := make([]string, 0, len(nameservers))
+	for _, ns := range nameservers {
+		ip := net.ParseIP(ns)
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		routable = append(routable, ns)
+	}
+
+	return routable
+}
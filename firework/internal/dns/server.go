@@ -0,0 +1,351 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Domain is the top level domain under which cluster nodes are resolvable.
+const Domain = "firework"
+
+const port = "53"
+const forwardTimeout = 5 * time.Second
+const maxMessageSize = 65535
+
+// tcpIdleTimeout is how long a TCP connection of a client is kept open without a query.
+const tcpIdleTimeout = 10 * time.Second
+
+// Zone returns the fully qualified domain of a cluster, e.g. "default.firework.".
+func Zone(cluster string) string {
+	return strings.ToLower(cluster) + "." + Domain + "."
+}
+
+// Server answers A queries for nodes of a single cluster and forwards all other
+// queries to upstream nameservers.
+type Server struct {
+	zone      string
+	upstreams []string
+
+	mu      sync.RWMutex
+	records map[string]net.IP
+
+	conn     net.PacketConn
+	listener net.Listener
+}
+
+func NewServer(cluster string, upstreams []string) *Server {
+	return &Server{
+		zone:      Zone(cluster),
+		upstreams: upstreams,
+		records:   make(map[string]net.IP),
+	}
+}
+
+func (s *Server) fqdn(name string) string {
+	return strings.ToLower(name) + "." + s.zone
+}
+
+// SetHost adds or replaces the record of a node.
+func (s *Server) SetHost(name string, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[s.fqdn(name)] = ip
+	slog.Debug("Updated DNS record", "name", s.fqdn(name), "ip", ip)
+}
+
+// RemoveHost removes the record of a node.
+func (s *Server) RemoveHost(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, s.fqdn(name))
+	slog.Debug("Removed DNS record", "name", s.fqdn(name))
+}
+
+func (s *Server) lookup(fqdn string) (net.IP, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ip, ok := s.records[fqdn]
+	return ip, ok
+}
+
+// Listen binds the server to UDP and TCP port 53 on the given IP address. Clients retry over TCP
+// when a response over UDP is truncated.
+func (s *Server) Listen(ip net.IP) error {
+	addr := net.JoinHostPort(ip.String(), port)
+
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", ip, err)
+	}
+
+	listener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to listen on %s: %w", ip, err)
+	}
+
+	s.conn = conn
+	s.listener = listener
+	return nil
+}
+
+// Serve handles queries until the context is cancelled.
+func (s *Server) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+		s.listener.Close()
+	}()
+
+	go func() {
+		if err := s.serveTCP(ctx); err != nil {
+			slog.Error("DNS server stopped serving TCP", "error", err)
+		}
+	}()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		req := make([]byte, n)
+		copy(req, buf[:n])
+
+		go func() {
+			resp, err := s.handle(req, "udp")
+			if err != nil {
+				slog.Debug("Failed to handle DNS query", "from", addr, "error", err)
+				return
+			}
+
+			if _, err := s.conn.WriteTo(resp, addr); err != nil {
+				slog.Debug("Failed to write DNS response", "to", addr, "error", err)
+			}
+		}()
+	}
+}
+
+// serveTCP accepts TCP connections until the context is cancelled.
+func (s *Server) serveTCP(ctx context.Context) error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn answers the queries of a TCP connection, each prefixed with its length, until the
+// client closes it or is idle for too long.
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		if err := conn.SetDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+			return
+		}
+
+		req, err := readMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("Failed to read DNS query", "from", conn.RemoteAddr(), "error", err)
+			}
+			return
+		}
+
+		resp, err := s.handle(req, "tcp")
+		if err != nil {
+			slog.Debug("Failed to handle DNS query", "from", conn.RemoteAddr(), "error", err)
+			return
+		}
+
+		if err := writeMessage(conn, resp); err != nil {
+			slog.Debug("Failed to write DNS response", "to", conn.RemoteAddr(), "error", err)
+			return
+		}
+	}
+}
+
+// readMessage reads a DNS message with the two byte length prefix used over TCP.
+func readMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func writeMessage(w io.Writer, msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return fmt.Errorf("message of %d bytes is too large", len(msg))
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// handle answers a query received over network, which is udp or tcp. Forwarded queries use the
+// same network, so that a truncated upstream response is only returned to UDP clients, which can
+// then retry over TCP.
+func (s *Server) handle(req []byte, network string) ([]byte, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.ToLower(q.Name.String())
+	if strings.HasSuffix(name, "."+Domain+".") {
+		return s.answer(hdr, q)
+	}
+
+	resp, err := s.forward(req, network)
+	if err != nil {
+		slog.Debug("Failed to forward DNS query", "name", name, "error", err)
+		return reply(hdr, q, dnsmessage.RCodeServerFailure, nil)
+	}
+
+	return resp, nil
+}
+
+// answer responds authoritatively to a query for a name in the firework domain.
+func (s *Server) answer(hdr dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	ip, ok := s.lookup(strings.ToLower(q.Name.String()))
+	if !ok {
+		return reply(hdr, q, dnsmessage.RCodeNameError, nil)
+	}
+
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeALL {
+		return reply(hdr, q, dnsmessage.RCodeSuccess, nil)
+	}
+
+	return reply(hdr, q, dnsmessage.RCodeSuccess, ip.To4())
+}
+
+func reply(hdr dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, ip net.IP) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		Authoritative:      rcode != dnsmessage.RCodeServerFailure,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+
+	if ip != nil {
+		if err := b.StartAnswers(); err != nil {
+			return nil, err
+		}
+
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+
+		err := b.AResource(dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   5,
+		}, a)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+// forward sends the raw query to each upstream in turn over network and returns the first response.
+func (s *Server) forward(req []byte, network string) ([]byte, error) {
+	if len(s.upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream nameservers")
+	}
+
+	var lastErr error
+	for _, upstream := range s.upstreams {
+		resp, err := exchange(network, upstream, req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+func exchange(network, upstream string, req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, net.JoinHostPort(upstream, port), forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(forwardTimeout)); err != nil {
+		return nil, err
+	}
+
+	if network == "tcp" {
+		if err := writeMessage(conn, req); err != nil {
+			return nil, err
+		}
+		return readMessage(conn)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
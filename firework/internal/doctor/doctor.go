@@ -0,0 +1,302 @@
+package doctor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	units "github.com/docker/go-units"
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/network"
+	"github.com/jlkiri/firework/internal/vm"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Minimum host kernel version and free disk space in the data directory.
+const (
+	minKernelMajor = 5
+	minFreeSpace   = 1 * units.GiB
+)
+
+type Status int
+
+const (
+	StatusOk Status = iota
+	StatusWarn
+	StatusFail
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOk:
+		return " OK "
+	case StatusWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// Result is the outcome of a check. Remedy tells the user how to fix a warning or failure.
+type Result struct {
+	Name    string
+	Status  Status
+	Message string
+	Remedy  string
+}
+
+func ok(name, format string, args ...interface{}) Result {
+	return Result{Name: name, Status: StatusOk, Message: fmt.Sprintf(format, args...)}
+}
+
+func warn(name, remedy, format string, args ...interface{}) Result {
+	return Result{Name: name, Status: StatusWarn, Message: fmt.Sprintf(format, args...), Remedy: remedy}
+}
+
+func fail(name, remedy, format string, args ...interface{}) Result {
+	return Result{Name: name, Status: StatusFail, Message: fmt.Sprintf(format, args...), Remedy: remedy}
+}
+
+// Run checks whether the host can run the cluster in conf. bins and binsErr are the result of
+// vm.FindBinaries, which firework start needs anyway and is not run twice.
+func Run(conf config.Config, bins vm.Binaries, binsErr error) []Result {
+	return []Result{
+		checkKvm(),
+		checkKernel(),
+		checkFirecracker(bins, binsErr),
+		checkMkfs(conf.Nodes),
+		checkIptables(),
+		checkIpForward(),
+		checkBrNetfilter(),
+		checkSubnet(conf.SubnetCidr),
+		checkDiskSpace(conf.Nodes),
+	}
+}
+
+// Failed reports whether any check failed. Warnings do not count as failures.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if r.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+func Print(w io.Writer, results []Result) {
+	for _, r := range results {
+		fmt.Fprintf(w, "[%s] %s: %s\n", r.Status, r.Name, r.Message)
+		if r.Remedy != "" {
+			fmt.Fprintf(w, "       %s\n", r.Remedy)
+		}
+	}
+}
+
+func checkKvm() Result {
+	const name = "KVM"
+
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return fail(name, "Enable virtualization (VT-x/AMD-V) in the BIOS, or nested virtualization on a cloud VM, and load kvm_intel or kvm_amd", "/dev/kvm does not exist")
+	}
+	if err != nil {
+		return fail(name, "Run firework as root or grant access, e.g. sudo setfacl -m u:$USER:rw /dev/kvm", "cannot open /dev/kvm: %v", err)
+	}
+	f.Close()
+
+	return ok(name, "/dev/kvm is accessible")
+}
+
+func checkKernel() Result {
+	const name = "Kernel"
+
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return warn(name, "", "cannot determine kernel version: %v", err)
+	}
+
+	release := unix.ByteSliceToString(uts.Release[:])
+	major, err := strconv.Atoi(strings.SplitN(release, ".", 2)[0])
+	if err != nil {
+		return warn(name, "", "cannot parse kernel version %s", release)
+	}
+
+	if major < minKernelMajor {
+		return fail(name, fmt.Sprintf("Upgrade the host kernel to %d.x or newer", minKernelMajor), "kernel %s is too old", release)
+	}
+
+	return ok(name, "%s", release)
+}
+
+func checkFirecracker(bins vm.Binaries, err error) Result {
+	const name = "Firecracker"
+
+	if err != nil {
+		return fail(name, fmt.Sprintf("Install Firecracker %s or newer from https://github.com/firecracker-microvm/firecracker/releases or set %s", vm.MinFirecrackerVersion, vm.FirecrackerBinEnv), "%v", err)
+	}
+
+	if bins.Jailer != "" {
+		return ok(name, "%s at %s, jailer at %s", bins.Version, bins.Firecracker, bins.Jailer)
+	}
+
+	return ok(name, "%s at %s", bins.Version, bins.Firecracker)
+}
+
+// checkMkfs only fails if a node has an overlay disk whose template is not cached yet, because
+// mkfs.ext4 is not needed otherwise.
+func checkMkfs(nodes []config.Node) Result {
+	const name = "mkfs.ext4"
+	const remedy = "Install e2fsprogs, e.g. apt install e2fsprogs"
+
+	path, err := exec.LookPath(name)
+	if err == nil {
+		return ok(name, "%s", path)
+	}
+
+	for _, node := range nodes {
+		if node.Overlay == config.OverlayRam {
+			continue
+		}
+
+		template := config.OverlayTemplatePath(node.Disk)
+		if _, err := os.Stat(template); err != nil {
+			return fail(name, remedy, "not found in $PATH, but needed to create %s for node %s", template, node.Name)
+		}
+	}
+
+	return warn(name, remedy, "not found in $PATH, overlay disks of a new size cannot be created")
+}
+
+func checkIptables() Result {
+	const name = "iptables"
+	const remedy = "Install iptables (the iptables-nft variant works with nftables) and run firework as root"
+
+	ipt, err := iptables.New()
+	if err != nil {
+		return fail(name, remedy, "%v", err)
+	}
+
+	if _, err := ipt.List(string(network.TableNat), string(network.ChainPostrouting)); err != nil {
+		return fail(name, remedy, "cannot list the nat table: %v", err)
+	}
+
+	version, _ := exec.Command("iptables", "--version").Output()
+	return ok(name, "%s", strings.TrimSpace(string(version)))
+}
+
+func checkIpForward() Result {
+	const name = "IP forwarding"
+
+	value, err := os.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		return warn(name, "", "cannot read net.ipv4.ip_forward: %v", err)
+	}
+
+	if strings.TrimSpace(string(value)) != "1" {
+		return fail(name, "Enable it with sudo sysctl -w net.ipv4.ip_forward=1", "disabled, VMs cannot reach the Internet")
+	}
+
+	return ok(name, "enabled")
+}
+
+// checkBrNetfilter warns if bridged traffic between VMs bypasses iptables. VMs still reach each
+// other through the bridge, but iptables rules do not apply to that traffic.
+func checkBrNetfilter() Result {
+	const name = "br_netfilter"
+	const remedy = "Load the module with sudo modprobe br_netfilter and enable it with sudo sysctl -w net.bridge.bridge-nf-call-iptables=1"
+
+	value, err := os.ReadFile("/proc/sys/net/bridge/bridge-nf-call-iptables")
+	if errors.Is(err, os.ErrNotExist) {
+		return warn(name, remedy, "module is not loaded, bridged traffic bypasses iptables")
+	}
+	if err != nil {
+		return warn(name, "", "cannot read net.bridge.bridge-nf-call-iptables: %v", err)
+	}
+
+	if strings.TrimSpace(string(value)) != "1" {
+		return warn(name, remedy, "loaded but bridged traffic bypasses iptables")
+	}
+
+	return ok(name, "loaded")
+}
+
+// checkSubnet fails if the subnet of the cluster overlaps a route of another interface,
+// e.g. a docker bridge or a VPN, because traffic of the VMs would be misrouted.
+func checkSubnet(subnetCidr string) Result {
+	const name = "Subnet"
+
+	_, subnet, err := net.ParseCIDR(subnetCidr)
+	if err != nil {
+		return fail(name, "Set subnet_cidr in config.json to a valid CIDR, e.g. 172.18.0.0/24", "invalid subnet_cidr %q", subnetCidr)
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return warn(name, "", "cannot list routes: %v", err)
+	}
+
+	for _, route := range routes {
+		if route.Dst == nil || !(route.Dst.Contains(subnet.IP) || subnet.Contains(route.Dst.IP)) {
+			continue
+		}
+
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			continue
+		}
+
+		// The bridge of a cluster that is already running.
+		if link.Attrs().Name == network.VM_BRIDGE_NAME {
+			continue
+		}
+
+		return fail(name, "Choose a subnet_cidr in config.json that is not used on the host", "%s overlaps %s on %s", subnet, route.Dst, link.Attrs().Name)
+	}
+
+	return ok(name, "%s is free", subnet)
+}
+
+func checkDiskSpace(nodes []config.Node) Result {
+	const name = "Disk space"
+
+	// The data directory does not exist before the first start.
+	dir := config.DataDir
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == "/" {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return warn(name, "", "cannot determine free space of %s: %v", dir, err)
+	}
+
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	if free < minFreeSpace {
+		return fail(name, fmt.Sprintf("Free up space on the filesystem of %s", config.DataDir), "only %s free in %s", units.BytesSize(float64(free)), dir)
+	}
+
+	// Overlay disks are sparse, so they only fail once the VMs actually write that much.
+	var capacity int64
+	for _, node := range nodes {
+		if node.Overlay != config.OverlayRam {
+			capacity += node.Disk * units.GiB
+		}
+	}
+
+	if free < capacity {
+		return warn(name, "Free up space or reduce the disk of the nodes", "%s free in %s but overlay disks can grow up to %s", units.BytesSize(float64(free)), dir, units.BytesSize(float64(capacity)))
+	}
+
+	return ok(name, "%s free in %s", units.BytesSize(float64(free)), dir)
+}
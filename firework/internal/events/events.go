@@ -0,0 +1,197 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Types of lifecycle events.
+const (
+	Created        = "created"         // The machine was created and waits to be started
+	Booted         = "booted"          // The VMM started and the guest is booting
+	Ready          = "ready"           // The guest passed its readiness checks
+	Exited         = "exited"          // The VMM exited, ExitCode says how
+	Restarted      = "restarted"       // The machine was recreated by its restart policy
+	NetworkChanged = "network_changed" // A machine joined or left the host table of the cluster
+)
+
+// followInterval is how often Follow checks the journal for new events.
+const followInterval = 250 * time.Millisecond
+
+// Event is a line of the journal.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Cluster  string    `json:"cluster,omitempty"`
+	Machine  string    `json:"machine"`
+	VmId     string    `json:"vm_id,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"` // Set for exited events, -1 if the VMM was killed by a signal
+	Error    string    `json:"error,omitempty"`
+	// Details depend on the type, e.g. the PID of a booted machine or the boot time of a ready one.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Journal appends events to a file with one JSON object per line. A nil Journal drops all events.
+type Journal struct {
+	cluster string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Open opens the journal at path for appending events of the given cluster.
+func Open(path string, cluster string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event journal: %w", err)
+	}
+
+	return &Journal{cluster: cluster, f: f}, nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+// Emit appends an event. Every event is written with a single write so that readers never see
+// a partial line. Failures are logged because they must not affect the machines.
+func (j *Journal) Emit(e Event) {
+	if j == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Cluster = j.cluster
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Failed to encode event", "type", e.Type, "machine", e.Machine, "error", err)
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		slog.Error("Failed to write event", "type", e.Type, "machine", e.Machine, "error", err)
+	}
+}
+
+// Filter selects events. The zero Filter selects all events.
+type Filter struct {
+	Since    time.Time
+	Machines []string
+}
+
+func (f Filter) match(e Event) bool {
+	if e.Time.Before(f.Since) {
+		return false
+	}
+
+	if len(f.Machines) == 0 {
+		return true
+	}
+
+	for _, name := range f.Machines {
+		if e.Machine == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Read calls fn for every event in the journal at path that matches filter.
+func Read(path string, filter Filter, fn func(Event) error) error {
+	return read(context.Background(), path, filter, false, fn)
+}
+
+// Follow is like Read but keeps waiting for new events until ctx is done.
+func Follow(ctx context.Context, path string, filter Filter, fn func(Event) error) error {
+	return read(ctx, path, filter, true, fn)
+}
+
+func read(ctx context.Context, path string, filter Filter, follow bool, fn func(Event) error) error {
+	f, err := openForReading(ctx, path, follow)
+	if err != nil || f == nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var partial []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Keep a line that is still being written until its newline arrives.
+			partial = append(partial, line...)
+			if !follow {
+				return nil
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(followInterval):
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		line = append(partial, line...)
+		partial = nil
+
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			slog.Warn("Skipping malformed event", "error", err)
+			continue
+		}
+
+		if !filter.match(e) {
+			continue
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// openForReading opens the journal. If it does not exist yet, Read returns no events and Follow
+// waits until it is created.
+func openForReading(ctx context.Context, path string, follow bool) (*os.File, error) {
+	for {
+		f, err := os.Open(path)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if !follow {
+			return nil, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-time.After(followInterval):
+		}
+	}
+}
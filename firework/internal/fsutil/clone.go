@@ -0,0 +1,66 @@
+package fsutil
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneFile copies src to dst sharing extents with FICLONE where the filesystem supports
+// reflinks (btrfs, xfs) and falls back to a copy that preserves holes otherwise.
+func CloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return nil
+	}
+
+	return sparseCopy(in, out)
+}
+
+// sparseCopy copies only the data regions of src, found with SEEK_DATA and SEEK_HOLE,
+// and extends dst to the size of src so that holes stay unallocated.
+func sparseCopy(src, dst *os.File) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(int(src.Fd()), offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// No more data after offset.
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		end, err := unix.Seek(int(src.Fd()), start, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+
+		section := io.NewSectionReader(src, start, end-start)
+		if _, err := io.Copy(io.NewOffsetWriter(dst, start), section); err != nil {
+			return err
+		}
+
+		offset = end
+	}
+
+	return dst.Truncate(size)
+}
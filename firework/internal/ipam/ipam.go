@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"fmt"
 	"net/netip"
-	"os"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -13,37 +12,34 @@ type IPAM struct {
 	db *sql.DB
 }
 
+// NewIPAM opens the database at dbPath and fills it with the free IP addresses of cidr.
+// Leases of a previous cluster are dropped, while other tables in the database are kept.
 func NewIPAM(dbPath string, cidr string) (*IPAM, error) {
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		// Create IPAM database if it doesn't exist
-		db, err := createIpamSqliteDatabase(dbPath, cidr)
-		if err != nil {
-			return nil, err
-		}
-
-		return &IPAM{
-			db: db,
-		}, nil
-	}
-
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database %s: %w", dbPath, err)
 	}
 
+	if err := createIpamTable(db, cidr); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &IPAM{
 		db: db,
 	}, nil
 }
 
-func createIpamSqliteDatabase(pathname string, cidr string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", pathname)
+func createIpamTable(db *sql.DB, cidr string) error {
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer tx.Rollback()
 
 	// Create a table
 	schema := `
+	DROP TABLE IF EXISTS ips;
 	CREATE TABLE ips (
 		addr TEXT PRIMARY KEY,
 		is_free INTEGER,
@@ -51,28 +47,28 @@ func createIpamSqliteDatabase(pathname string, cidr string) (*sql.DB, error) {
 	);
 	`
 
-	_, err = db.Exec(schema)
+	_, err = tx.Exec(schema)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Define the CIDR block
 	prefix, err := netip.ParsePrefix(cidr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Insert all IP addresses in the CIDR block into the database
 	for ip := prefix.Addr().Next().Next(); prefix.Contains(ip); ip = ip.Next() {
 		// Transform the IP into the CIDR so that the string representation has the slash suffix
 		addr := fmt.Sprintf("%s/%d", ip.String(), prefix.Bits())
-		_, err := db.Exec("INSERT INTO ips (addr, is_free) VALUES (?, ?)", addr, 1)
+		_, err := tx.Exec("INSERT INTO ips (addr, is_free) VALUES (?, ?)", addr, 1)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	return db, nil
+	return tx.Commit()
 }
 
 func (ipam *IPAM) AllocateFreeIPAddress(hostname string) (string, error) {
@@ -91,3 +87,28 @@ func (ipam *IPAM) AllocateFreeIPAddress(hostname string) (string, error) {
 
 	return addr, nil
 }
+
+// AllocateIPAddress marks a specific IP address as used, e.g. for a machine restored from a snapshot.
+func (ipam *IPAM) AllocateIPAddress(addr string, hostname string) error {
+	res, err := ipam.db.Exec("UPDATE ips SET is_free = 0, hostname = ? WHERE addr = ? AND is_free = 1", hostname, addr)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("IP address %s is not free or not in the subnet", addr)
+	}
+
+	return nil
+}
+
+// ReleaseIPAddress marks an IP address as free again.
+func (ipam *IPAM) ReleaseIPAddress(addr string) error {
+	_, err := ipam.db.Exec("UPDATE ips SET is_free = 1, hostname = NULL WHERE addr = ?", addr)
+	return err
+}
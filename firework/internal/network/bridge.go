@@ -32,6 +32,7 @@ func createTapDevice(name string) (*netlink.Tuntap, error) {
 	}
 
 	if err := netlink.LinkSetUp(dev); err != nil {
+		netlink.LinkDel(dev)
 		return nil, fmt.Errorf("could not create %s: %w", la.Name, err)
 	}
 
@@ -41,6 +42,8 @@ func createTapDevice(name string) (*netlink.Tuntap, error) {
 type BridgeNetwork struct {
 	bridge *netlink.Bridge
 	ipAddr net.IP
+	// created is true if the bridge did not exist before.
+	created bool
 }
 
 func NewBridgeNetwork(subnetCidr string, gateway string) (*BridgeNetwork, error) {
@@ -61,7 +64,7 @@ func NewBridgeNetwork(subnetCidr string, gateway string) (*BridgeNetwork, error)
 		}
 
 		// Assume that the route to VM_SUBNET is already added and iptables rules are already set up
-		return &BridgeNetwork{br, addrs[0].IP}, nil
+		return &BridgeNetwork{br, addrs[0].IP, false}, nil
 	}
 
 	bridge, err := createBridge(VM_BRIDGE_NAME)
@@ -69,6 +72,17 @@ func NewBridgeNetwork(subnetCidr string, gateway string) (*BridgeNetwork, error)
 		return nil, fmt.Errorf("failed to create bridge %s: %w", VM_BRIDGE_NAME, err)
 	}
 
+	n, err := setupBridge(bridge, subnetCidr, gateway)
+	if err != nil {
+		// Do not leave a half-configured bridge behind.
+		netlink.LinkDel(bridge)
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func setupBridge(bridge *netlink.Bridge, subnetCidr string, gateway string) (*BridgeNetwork, error) {
 	bridgeIpAddr, err := netlink.ParseAddr(gateway)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse bridge IP address %s: %w", gateway, err)
@@ -86,7 +100,25 @@ func NewBridgeNetwork(subnetCidr string, gateway string) (*BridgeNetwork, error)
 		return nil, fmt.Errorf("failed to set up iptables: %w", err)
 	}
 
-	return &BridgeNetwork{bridge, bridgeIpAddr.IP}, nil
+	return &BridgeNetwork{bridge, bridgeIpAddr.IP, true}, nil
+}
+
+// Remove deletes the bridge and its iptables rules if NewBridgeNetwork created them. A bridge that
+// already existed is left as it was.
+func (n *BridgeNetwork) Remove(subnetCidr string) error {
+	if !n.created {
+		return nil
+	}
+
+	if err := cleanupIptables(subnetCidr); err != nil {
+		return fmt.Errorf("failed to cleanup iptables: %w", err)
+	}
+
+	if err := netlink.LinkDel(n.bridge); err != nil {
+		return fmt.Errorf("failed to delete bridge %s: %w", VM_BRIDGE_NAME, err)
+	}
+
+	return nil
 }
 
 func (n *BridgeNetwork) CreateTapDevice(id string) (*netlink.Tuntap, error) {
@@ -97,12 +129,21 @@ func (n *BridgeNetwork) CreateTapDevice(id string) (*netlink.Tuntap, error) {
 	}
 
 	if err := netlink.LinkSetMaster(tap, n.bridge); err != nil {
+		netlink.LinkDel(tap)
 		return nil, fmt.Errorf("failed to set master for tap %s: %w", ifaceName, err)
 	}
 
 	return tap, nil
 }
 
+func (n *BridgeNetwork) DeleteTapDevice(tap *netlink.Tuntap) error {
+	if err := netlink.LinkDel(tap); err != nil {
+		return fmt.Errorf("failed to delete tap %s: %w", tap.Name, err)
+	}
+
+	return nil
+}
+
 func (n *BridgeNetwork) GetIPAddr() net.IP {
 	return n.ipAddr
 }
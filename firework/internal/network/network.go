@@ -17,6 +17,7 @@ const (
 type Chain string
 
 const (
+	ChainInput       Chain = "INPUT"
 	ChainForward     Chain = "FORWARD"
 	ChainPostrouting Chain = "POSTROUTING"
 )
@@ -54,6 +55,11 @@ func cleanupIptables(subnetCidr string) error {
 	if err := ipt.DeleteIfExists(string(TableFilter), string(ChainForward), "-o", VM_BRIDGE_NAME, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", string(TargetAccept)); err != nil {
 		return err
 	}
+	for _, proto := range []string{"udp", "tcp"} {
+		if err := ipt.DeleteIfExists(string(TableFilter), string(ChainInput), "-i", VM_BRIDGE_NAME, "-p", proto, "--dport", "53", "-j", string(TargetAccept)); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -77,6 +83,12 @@ func setupIptables(subnetCidr string) error {
 	if err := ipt.AppendUnique(string(TableFilter), string(ChainForward), "-o", VM_BRIDGE_NAME, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", string(TargetAccept)); err != nil {
 		return err
 	}
+	// Allow guests to reach the built-in DNS server on the bridge, over TCP for truncated responses.
+	for _, proto := range []string{"udp", "tcp"} {
+		if err := ipt.AppendUnique(string(TableFilter), string(ChainInput), "-i", VM_BRIDGE_NAME, "-p", proto, "--dport", "53", "-j", string(TargetAccept)); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
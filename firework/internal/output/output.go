@@ -0,0 +1,130 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats. The default is a table.
+const (
+	FormatTable    = ""
+	FormatWide     = "wide"
+	FormatJson     = "json"
+	FormatYaml     = "yaml"
+	FormatTemplate = "template"
+)
+
+// Options select how a command that lists items prints them.
+type Options struct {
+	Format string
+	// Template is a Go template that is executed for every item with FormatTemplate.
+	Template string
+}
+
+// AddFlags adds -o and --template to a command.
+func AddFlags(cmd *cobra.Command, o *Options) {
+	cmd.Flags().StringVarP(&o.Format, "output", "o", FormatTable, "Output format: json, yaml, wide or template")
+	cmd.Flags().StringVar(&o.Template, "template", "", "Go template executed for every item with -o template, e.g. '{{.Name}}'")
+}
+
+// Validate checks the options before a command does any work.
+func (o Options) Validate() error {
+	switch o.Format {
+	case FormatTable, FormatWide, FormatJson, FormatYaml:
+		return nil
+	case FormatTemplate:
+		if o.Template == "" {
+			return fmt.Errorf("-o template requires --template")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q, must be one of json, yaml, wide or template", o.Format)
+	}
+}
+
+// Table is the plain text form of a list of items.
+type Table struct {
+	Header []string
+	Rows   [][]string
+}
+
+func (t Table) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.Header, "\t"))
+	for _, row := range t.Rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// Print writes items, which must be a slice, in the selected format. table renders the items as a
+// table and is told whether the wide table was requested.
+func (o Options) Print(w io.Writer, items any, table func(wide bool) Table) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	switch o.Format {
+	case FormatJson:
+		b, err := json.MarshalIndent(items, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case FormatYaml:
+		return printYaml(w, items)
+	case FormatTemplate:
+		return printTemplate(w, o.Template, items)
+	default:
+		return table(o.Format == FormatWide).Print(w)
+	}
+}
+
+// printYaml converts items to YAML through JSON so that both formats have the same field names.
+// Fields of the items keep their order.
+func printYaml(w io.Writer, items any) error {
+	b, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	var list []yaml.MapSlice
+	if err := yaml.Unmarshal(b, &list); err != nil {
+		return err
+	}
+
+	b, err = yaml.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func printTemplate(w io.Writer, text string, items any) error {
+	tmpl, err := template.New("output").Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+
+	v := reflect.ValueOf(items)
+	for i := 0; i < v.Len(); i++ {
+		if err := tmpl.Execute(w, v.Index(i).Interface()); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/fsutil"
+	"github.com/jlkiri/firework/internal/state"
+	"github.com/jlkiri/firework/internal/vm"
+	"golang.org/x/exp/slog"
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Machine is the identity of a snapshotted machine. A restored machine must reuse it
+// because the snapshot refers to its tap device, drive paths and vsock CID.
+type Machine struct {
+	Name    string `json:"name"`
+	VmId    string `json:"vm_id"`
+	Cid     uint32 `json:"cid"`
+	Ipv4    string `json:"ipv4"`
+	Overlay bool   `json:"overlay"`
+}
+
+// Manifest describes a snapshot. Config is the cluster config at the time of the snapshot
+// with its nodes limited to the snapshotted machines.
+type Manifest struct {
+	Name      string        `json:"name"`
+	CreatedAt time.Time     `json:"created_at"`
+	Config    config.Config `json:"config"`
+	Machines  []Machine     `json:"machines"`
+}
+
+func Dir(name string) string {
+	return filepath.Join(config.SnapshotsDir, name)
+}
+
+func manifestPath(name string) string {
+	return filepath.Join(Dir(name), "manifest.json")
+}
+
+func MemPath(name, machine string) string {
+	return filepath.Join(Dir(name), machine+".mem")
+}
+
+func StatePath(name, machine string) string {
+	return filepath.Join(Dir(name), machine+".state")
+}
+
+func OverlayPath(name, machine string) string {
+	return filepath.Join(Dir(name), machine+"-overlay.ext4")
+}
+
+func Read(name string) (Manifest, error) {
+	file, err := os.ReadFile(manifestPath(name))
+	if os.IsNotExist(err) {
+		return Manifest{}, fmt.Errorf("snapshot %s does not exist", name)
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(file, &manifest); err != nil {
+		return Manifest{}, err
+	}
+
+	return manifest, nil
+}
+
+func (m Manifest) write() error {
+	bytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(manifestPath(m.Name), bytes, 0644)
+}
+
+// List returns all snapshots from oldest to newest.
+func List() ([]Manifest, error) {
+	entries, err := os.ReadDir(config.SnapshotsDir)
+	if os.IsNotExist(err) {
+		return []Manifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make([]Manifest, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		manifest, err := Read(entry.Name())
+		if err != nil {
+			// Skip snapshots that were interrupted before the manifest was written.
+			continue
+		}
+
+		manifests = append(manifests, manifest)
+	}
+
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].CreatedAt.Before(manifests[j].CreatedAt)
+	})
+
+	return manifests, nil
+}
+
+func Remove(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+
+	if _, err := os.Stat(Dir(name)); err != nil {
+		return fmt.Errorf("snapshot %s does not exist", name)
+	}
+
+	return os.RemoveAll(Dir(name))
+}
+
+type target struct {
+	name    string
+	entry   state.Machine
+	machine *firecracker.Machine
+}
+
+// Create pauses the named machines, writes their memory and state and copies their overlay drives.
+// All machines are paused before the first snapshot is taken so that a cluster is captured at a
+// single point in time, and they are resumed when Create returns.
+func Create(ctx context.Context, name string, conf config.Config, names []string) (Manifest, error) {
+	if !validName.MatchString(name) {
+		return Manifest{}, fmt.Errorf("invalid snapshot name %q: must contain only letters, digits, '_', '.' and '-'", name)
+	}
+
+	// Snapshot files would have to be written to and loaded from inside the chroot of each machine.
+	if conf.Jailer != nil {
+		return Manifest{}, fmt.Errorf("snapshots are not supported in jailer mode")
+	}
+
+	if len(names) == 0 {
+		return Manifest{}, fmt.Errorf("no running machines to snapshot")
+	}
+
+	if _, err := os.Stat(Dir(name)); err == nil {
+		return Manifest{}, fmt.Errorf("snapshot %s already exists", name)
+	}
+
+	nodes := make(map[string]config.Node, len(conf.Nodes))
+	for _, node := range conf.Nodes {
+		nodes[node.Name] = node
+	}
+
+	targets := make([]target, 0, len(names))
+	for _, n := range names {
+		if _, ok := nodes[n]; !ok {
+			return Manifest{}, fmt.Errorf("node %s is not in the config", n)
+		}
+
+		m, entry, err := vm.ConnectByName(ctx, n)
+		if err != nil {
+			return Manifest{}, err
+		}
+
+		targets = append(targets, target{n, entry, m})
+	}
+
+	if err := os.MkdirAll(Dir(name), 0755); err != nil {
+		return Manifest{}, err
+	}
+
+	manifest, err := create(ctx, name, conf, nodes, targets)
+	if err != nil {
+		os.RemoveAll(Dir(name))
+		return Manifest{}, err
+	}
+
+	return manifest, nil
+}
+
+func create(ctx context.Context, name string, conf config.Config, nodes map[string]config.Node, targets []target) (Manifest, error) {
+	for _, t := range targets {
+		t := t
+		if err := t.machine.PauseVM(ctx); err != nil {
+			return Manifest{}, fmt.Errorf("failed to pause %s: %w", t.name, err)
+		}
+
+		defer func() {
+			if err := t.machine.ResumeVM(ctx); err != nil {
+				slog.Error("Failed to resume machine after snapshot", "name", t.name, "error", err)
+			}
+		}()
+	}
+
+	manifest := Manifest{
+		Name:      name,
+		CreatedAt: time.Now(),
+		Config:    conf,
+		Machines:  make([]Machine, 0, len(targets)),
+	}
+	manifest.Config.Nodes = make([]config.Node, 0, len(targets))
+
+	snapshotted := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		snapshotted[t.name] = true
+	}
+
+	for _, t := range targets {
+		var metadata vm.Metadata
+		if err := t.machine.GetMetadata(ctx, &metadata); err != nil {
+			return Manifest{}, err
+		}
+
+		if err := t.machine.CreateSnapshot(ctx, MemPath(name, t.name), StatePath(name, t.name)); err != nil {
+			return Manifest{}, fmt.Errorf("failed to snapshot %s: %w", t.name, err)
+		}
+
+		overlayPath := config.OverlayDrivePath(t.entry.VmId)
+		_, err := os.Stat(overlayPath)
+		hasOverlay := err == nil
+		if hasOverlay {
+			if err := fsutil.CloneFile(overlayPath, OverlayPath(name, t.name)); err != nil {
+				return Manifest{}, fmt.Errorf("failed to copy overlay drive of %s: %w", t.name, err)
+			}
+		}
+
+		manifest.Machines = append(manifest.Machines, Machine{
+			Name:    t.name,
+			VmId:    t.entry.VmId,
+			Cid:     metadata.Cid,
+			Ipv4:    metadata.Ipv4,
+			Overlay: hasOverlay,
+		})
+		manifest.Config.Nodes = append(manifest.Config.Nodes, withDependencies(nodes[t.name], snapshotted))
+		slog.Info("Created snapshot of machine", "name", t.name, "snapshot", name)
+	}
+
+	if err := manifest.write(); err != nil {
+		return Manifest{}, err
+	}
+
+	return manifest, nil
+}
+
+// withDependencies returns the node with only the dependencies on the given nodes.
+func withDependencies(node config.Node, names map[string]bool) config.Node {
+	deps := make([]config.Dependency, 0, len(node.DependsOn))
+	for _, dep := range node.DependsOn {
+		if names[dep.Name] {
+			deps = append(deps, dep)
+		}
+	}
+
+	node.DependsOn = deps
+	return node
+}
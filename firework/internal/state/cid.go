@@ -0,0 +1,116 @@
+package state
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MinCid is the lowest CID that can be allocated. CIDs 0 to 2 are reserved for the hypervisor
+// and the host.
+const MinCid = 3
+
+// The CID pool survives restarts of the cluster so that a node keeps its CID.
+const cidSchema = `
+CREATE TABLE IF NOT EXISTS cids (
+	cid INTEGER PRIMARY KEY,
+	cluster TEXT NOT NULL,
+	node TEXT NOT NULL,
+	UNIQUE (cluster, node)
+);
+`
+
+// AllocateCid returns the vsock CID of a node, which is unique on the host. A node keeps the CID
+// it got before unless a different one is requested. A requested CID of 0 means any CID.
+func (s *Store) AllocateCid(cluster, node string, requested uint32) (uint32, error) {
+	if requested != 0 && requested < MinCid {
+		return 0, fmt.Errorf("CID %d of node %s is reserved, it must be at least %d", requested, node, MinCid)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var current uint32
+	err = tx.QueryRow("SELECT cid FROM cids WHERE cluster = ? AND node = ?", cluster, node).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	if current != 0 && (requested == 0 || requested == current) {
+		return current, nil
+	}
+
+	cid := requested
+	if cid == 0 {
+		cid, err = freeCid(tx)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		var owner string
+		err := tx.QueryRow("SELECT cluster || '/' || node FROM cids WHERE cid = ?", cid).Scan(&owner)
+		if err == nil {
+			return 0, fmt.Errorf("CID %d of node %s is already used by %s", cid, node, owner)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO cids (cid, cluster, node) VALUES (?, ?, ?)", cid, cluster, node)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return cid, nil
+}
+
+// freeCid returns the lowest CID that is not allocated.
+func freeCid(tx *sql.Tx) (uint32, error) {
+	rows, err := tx.Query("SELECT cid FROM cids WHERE cid >= ? ORDER BY cid", MinCid)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cid := uint32(MinCid)
+	for rows.Next() {
+		var used uint32
+		if err := rows.Scan(&used); err != nil {
+			return 0, err
+		}
+		if used != cid {
+			break
+		}
+		cid++
+	}
+
+	return cid, rows.Err()
+}
+
+// ReleaseCids frees the CIDs of the nodes of a cluster that are not in nodes, e.g. because they
+// were removed from the config.
+func (s *Store) ReleaseCids(cluster string, nodes []string) error {
+	if len(nodes) == 0 {
+		_, err := s.db.Exec("DELETE FROM cids WHERE cluster = ?", cluster)
+		return err
+	}
+
+	args := make([]any, 0, len(nodes)+1)
+	args = append(args, cluster)
+	for _, node := range nodes {
+		args = append(args, node)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(nodes)), ", ")
+	_, err := s.db.Exec("DELETE FROM cids WHERE cluster = ? AND node NOT IN ("+placeholders+")", args...)
+	return err
+}
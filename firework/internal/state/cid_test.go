@@ -0,0 +1,201 @@
+package state
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type allocation struct {
+	cluster   string
+	node      string
+	requested uint32
+}
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	store, err := Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func allocate(t *testing.T, store *Store, allocations []allocation) {
+	t.Helper()
+
+	for _, a := range allocations {
+		if _, err := store.AllocateCid(a.cluster, a.node, a.requested); err != nil {
+			t.Fatalf("AllocateCid(%s, %s, %d): %v", a.cluster, a.node, a.requested, err)
+		}
+	}
+}
+
+func TestAllocateCid(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  []allocation
+		alloc   allocation
+		want    uint32
+		wantErr string
+	}{
+		{
+			name:  "first CID",
+			alloc: allocation{"c", "a", 0},
+			want:  MinCid,
+		},
+		{
+			name:   "reuse CID of node",
+			before: []allocation{{"c", "a", 0}, {"c", "b", 0}},
+			alloc:  allocation{"c", "b", 0},
+			want:   MinCid + 1,
+		},
+		{
+			name:   "same node in another cluster",
+			before: []allocation{{"c", "a", 0}},
+			alloc:  allocation{"d", "a", 0},
+			want:   MinCid + 1,
+		},
+		{
+			name:   "requested CID",
+			before: []allocation{{"c", "a", 0}},
+			alloc:  allocation{"c", "b", 42},
+			want:   42,
+		},
+		{
+			name:   "requested CID replaces previous CID",
+			before: []allocation{{"c", "a", 0}},
+			alloc:  allocation{"c", "a", 42},
+			want:   42,
+		},
+		{
+			name:   "requested CID of node itself",
+			before: []allocation{{"c", "a", 42}},
+			alloc:  allocation{"c", "a", 42},
+			want:   42,
+		},
+		{
+			name:    "requested CID used by another node",
+			before:  []allocation{{"c", "a", 42}},
+			alloc:   allocation{"c", "b", 42},
+			wantErr: "already used by c/a",
+		},
+		{
+			name:    "requested CID used in another cluster",
+			before:  []allocation{{"d", "a", 42}},
+			alloc:   allocation{"c", "a", 42},
+			wantErr: "already used by d/a",
+		},
+		{
+			name:    "reserved CID",
+			alloc:   allocation{"c", "a", 2},
+			wantErr: "is reserved",
+		},
+		{
+			name:   "fill gap",
+			before: []allocation{{"c", "a", MinCid}, {"c", "b", MinCid + 2}},
+			alloc:  allocation{"c", "c", 0},
+			want:   MinCid + 1,
+		},
+		{
+			name:   "skip requested CIDs",
+			before: []allocation{{"c", "a", MinCid}, {"c", "b", MinCid + 1}, {"c", "c", 100}},
+			alloc:  allocation{"c", "d", 0},
+			want:   MinCid + 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t)
+			allocate(t, store, tt.before)
+
+			got, err := store.AllocateCid(tt.alloc.cluster, tt.alloc.node, tt.alloc.requested)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got CID %d and error %v, want error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got CID %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseCids(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  []allocation
+		cluster string
+		keep    []string
+		alloc   allocation
+		want    uint32
+	}{
+		{
+			name:    "removed node frees its CID",
+			before:  []allocation{{"c", "a", 0}, {"c", "b", 0}},
+			cluster: "c",
+			keep:    []string{"b"},
+			alloc:   allocation{"c", "x", 0},
+			want:    MinCid,
+		},
+		{
+			name:    "kept node keeps its CID",
+			before:  []allocation{{"c", "a", 0}, {"c", "b", 0}},
+			cluster: "c",
+			keep:    []string{"a", "b"},
+			alloc:   allocation{"c", "b", 0},
+			want:    MinCid + 1,
+		},
+		{
+			name:    "no nodes frees all CIDs of the cluster",
+			before:  []allocation{{"c", "a", 0}, {"c", "b", 0}},
+			cluster: "c",
+			alloc:   allocation{"c", "x", 0},
+			want:    MinCid,
+		},
+		{
+			name:    "other clusters keep their CIDs",
+			before:  []allocation{{"d", "a", 0}, {"c", "a", 0}},
+			cluster: "c",
+			alloc:   allocation{"d", "a", 0},
+			want:    MinCid,
+		},
+		{
+			name:    "released CID can be requested",
+			before:  []allocation{{"c", "a", 42}},
+			cluster: "c",
+			alloc:   allocation{"c", "b", 42},
+			want:    42,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t)
+			allocate(t, store, tt.before)
+
+			if err := store.ReleaseCids(tt.cluster, tt.keep); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.AllocateCid(tt.alloc.cluster, tt.alloc.node, tt.alloc.requested)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got CID %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package state
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Lifecycle states of a machine.
+const (
+	StateCreated    = "created"    // Created but not started yet, e.g. waiting for dependencies
+	StateStarting   = "starting"   // The VMM is starting
+	StateRunning    = "running"    // The VMM is running
+	StateReady      = "ready"      // The VMM is running and the guest passed its readiness checks
+	StateRestarting = "restarting" // Exited and about to be restarted
+	StateExited     = "exited"     // Exited cleanly and not restarted
+	StateFailed     = "failed"     // Exited with an error and not restarted
+)
+
+// Machine is the record of a machine of the running cluster.
+type Machine struct {
+	Name       string    `json:"name"`
+	VmId       string    `json:"vm_id"`
+	Pid        int       `json:"pid"` // 0 while the VMM is not running
+	SocketPath string    `json:"socket_path"`
+	VsockPath  string    `json:"vsock_path"`
+	Tap        string    `json:"tap"`
+	Ipv4       string    `json:"ipv4"`
+	Cid        uint32    `json:"cid"`
+	ConfigHash string    `json:"config_hash"` // Hash of the node config the machine was created from
+	Config     string    `json:"-"`           // The node config the machine was created from as JSON
+	State      string    `json:"state"`
+	Restarts   int       `json:"restarts"`
+	StartedAt  time.Time `json:"started_at"` // Zero if the machine never started
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Running reports whether the VMM of the machine is running.
+func (m Machine) Running() bool {
+	return m.State == StateRunning || m.State == StateReady
+}
+
+// Store keeps the state of the machines of a cluster and the vsock CIDs of the host in the SQLite
+// database that also holds the IP addresses. Every update is a single statement, so readers in other processes never
+// see a partial update.
+type Store struct {
+	db *sql.DB
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS machines (
+	name TEXT PRIMARY KEY,
+	vm_id TEXT NOT NULL,
+	pid INTEGER NOT NULL DEFAULT 0,
+	socket_path TEXT NOT NULL,
+	vsock_path TEXT NOT NULL,
+	tap TEXT NOT NULL,
+	ipv4 TEXT NOT NULL,
+	cid INTEGER NOT NULL,
+	config_hash TEXT NOT NULL,
+	config TEXT NOT NULL DEFAULT '',
+	state TEXT NOT NULL,
+	restarts INTEGER NOT NULL DEFAULT 0,
+	started_at INTEGER NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS supervisor (
+	id INTEGER PRIMARY KEY CHECK (id = 0),
+	pid INTEGER NOT NULL
+);
+`
+
+// ErrNoCluster is returned by OpenExisting if no cluster was started.
+var ErrNoCluster = errors.New("no cluster is running")
+
+// Open opens the state store in the database at dbPath and creates its tables if needed.
+func Open(dbPath string) (*Store, error) {
+	// Wait for writers in other processes instead of failing with "database is locked".
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", dbPath, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	for _, schema := range []string{schema, cidSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create state tables: %w", err)
+		}
+	}
+
+	if err := addColumn(db, "machines", "config", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate state tables: %w", err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+// addColumn adds a column to a table that was created by an older version of firework.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// OpenExisting opens the state store of a started cluster, e.g. for a command that inspects it.
+func OpenExisting(dbPath string) (*Store, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, ErrNoCluster
+	}
+
+	return Open(dbPath)
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Reset forgets the machines and the supervisor of the previous cluster. The CID pool is kept.
+func (s *Store) Reset() error {
+	for _, table := range []string{"machines", "supervisor"} {
+		if _, err := s.db.Exec("DELETE FROM " + table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetSupervisor records the PID of the firework process that runs the machines of the cluster.
+func (s *Store) SetSupervisor(pid int) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO supervisor (id, pid) VALUES (0, ?)", pid)
+	return err
+}
+
+// ClearSupervisor forgets the supervisor if it is the process with the given PID.
+func (s *Store) ClearSupervisor(pid int) error {
+	_, err := s.db.Exec("DELETE FROM supervisor WHERE pid = ?", pid)
+	return err
+}
+
+// Supervisor returns the PID of the firework process that runs the machines, or 0 if there is none
+// or it is not running anymore.
+func (s *Store) Supervisor() (int, error) {
+	var pid int
+	err := s.db.QueryRow("SELECT pid FROM supervisor WHERE id = 0").Scan(&pid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if !isFirework(pid) {
+		return 0, nil
+	}
+
+	return pid, nil
+}
+
+// isFirework reports whether the process with the given PID runs the same program as this one,
+// so that a firework that was killed is not mistaken for an unrelated process that reused its PID.
+func isFirework(pid int) bool {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return false
+	}
+
+	self, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		return false
+	}
+
+	return string(comm) == string(self)
+}
+
+// Put inserts or replaces the record of a machine.
+func (s *Store) Put(m Machine) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO machines
+		(name, vm_id, pid, socket_path, vsock_path, tap, ipv4, cid, config_hash, config, state, restarts, started_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Name, m.VmId, m.Pid, m.SocketPath, m.VsockPath, m.Tap, m.Ipv4, m.Cid, m.ConfigHash, m.Config, m.State, m.Restarts,
+		unixNano(m.StartedAt), time.Now().UnixNano())
+	return err
+}
+
+// Remove deletes the record of a machine.
+func (s *Store) Remove(name string) error {
+	_, err := s.db.Exec("DELETE FROM machines WHERE name = ?", name)
+	return err
+}
+
+// SetRunning records that the VMM of a machine started with the given PID after the given number of restarts.
+func (s *Store) SetRunning(name string, pid int, restarts int) error {
+	now := time.Now().UnixNano()
+	return s.update(`UPDATE machines SET pid = ?, restarts = ?, state = ?, started_at = ?, updated_at = ? WHERE name = ?`,
+		pid, restarts, StateRunning, now, now, name)
+}
+
+// SetState changes the lifecycle state of a machine. The PID is cleared when the VMM is not running.
+func (s *Store) SetState(name string, state string) error {
+	now := time.Now().UnixNano()
+	if state == StateRunning || state == StateReady {
+		return s.update("UPDATE machines SET state = ?, updated_at = ? WHERE name = ?", state, now, name)
+	}
+
+	return s.update("UPDATE machines SET state = ?, pid = 0, updated_at = ? WHERE name = ?", state, now, name)
+}
+
+func (s *Store) update(query string, args ...any) error {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("no machine named %s", args[len(args)-1])
+	}
+
+	return nil
+}
+
+const columns = "name, vm_id, pid, socket_path, vsock_path, tap, ipv4, cid, config_hash, config, state, restarts, started_at, updated_at"
+
+// Get returns the record of the named machine.
+func (s *Store) Get(name string) (Machine, error) {
+	m, err := scan(s.db.QueryRow("SELECT "+columns+" FROM machines WHERE name = ?", name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Machine{}, fmt.Errorf("no machine named %s", name)
+	}
+
+	return m, err
+}
+
+// List returns the records of all machines ordered by name.
+func (s *Store) List() ([]Machine, error) {
+	rows, err := s.db.Query("SELECT " + columns + " FROM machines ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	machines := make([]Machine, 0)
+	for rows.Next() {
+		m, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+
+	return machines, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scan(row scanner) (Machine, error) {
+	var m Machine
+	var startedAt, updatedAt int64
+	err := row.Scan(&m.Name, &m.VmId, &m.Pid, &m.SocketPath, &m.VsockPath, &m.Tap, &m.Ipv4, &m.Cid, &m.ConfigHash,
+		&m.Config, &m.State, &m.Restarts, &startedAt, &updatedAt)
+	if err != nil {
+		return Machine{}, err
+	}
+
+	if startedAt != 0 {
+		m.StartedAt = time.Unix(0, startedAt)
+	}
+	m.UpdatedAt = time.Unix(0, updatedAt)
+
+	return m, nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,64 @@
+package state
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutGet(t *testing.T) {
+	store := openTestStore(t)
+
+	want := Machine{Name: "a", VmId: "id", ConfigHash: "hash", Config: `{"name":"a"}`, State: StateCreated}
+	if err := store.Put(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ConfigHash != want.ConfigHash || got.Config != want.Config || got.State != want.State {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// A database created before machines had a config column is migrated when it is opened.
+func TestOpenMigratesConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE machines (
+		name TEXT PRIMARY KEY, vm_id TEXT NOT NULL, pid INTEGER NOT NULL DEFAULT 0, socket_path TEXT NOT NULL,
+		vsock_path TEXT NOT NULL, tap TEXT NOT NULL, ipv4 TEXT NOT NULL, cid INTEGER NOT NULL,
+		config_hash TEXT NOT NULL, state TEXT NOT NULL, restarts INTEGER NOT NULL DEFAULT 0,
+		started_at INTEGER NOT NULL DEFAULT 0, updated_at INTEGER NOT NULL);
+		INSERT INTO machines (name, vm_id, socket_path, vsock_path, tap, ipv4, cid, config_hash, state, updated_at)
+		VALUES ('a', 'id', '', '', '', '', 3, 'hash', 'running', 0)`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening twice must not add the column twice.
+	for i := 0; i < 2; i++ {
+		store, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.Get("a")
+		store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.ConfigHash != "hash" || got.Config != "" {
+			t.Errorf("got %+v, want the old record without config", got)
+		}
+	}
+}
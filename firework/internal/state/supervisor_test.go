@@ -0,0 +1,42 @@
+package state
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestSupervisor(t *testing.T) {
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		pid  int
+		want int
+	}{
+		{name: "running", pid: os.Getpid(), want: os.Getpid()},
+		{name: "exited", pid: exited.Process.Pid, want: 0},
+		{name: "other program", pid: 1, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t)
+			if err := store.SetSupervisor(tt.pid); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.Supervisor()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("got supervisor %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// SetMemoryTarget resizes the balloon of a running machine so that the guest is left with
+// targetMib of its memory. The rest is returned to the host as the guest releases it.
+func SetMemoryTarget(ctx context.Context, m *firecracker.Machine, targetMib int64) error {
+	if _, err := m.GetBalloonConfig(ctx); err != nil {
+		return fmt.Errorf("machine has no balloon device: %w", err)
+	}
+
+	cfg, err := ExportConfig(m)
+	if err != nil {
+		return err
+	}
+
+	memSizeMib := *cfg.MachineConfig.MemSizeMib
+	if targetMib <= 0 || targetMib > memSizeMib {
+		return fmt.Errorf("memory target must be between 1 and %d MiB", memSizeMib)
+	}
+
+	return m.UpdateBalloon(ctx, memSizeMib-targetMib)
+}
@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jlkiri/firework/internal/config"
+)
+
+// MinFirecrackerVersion is the oldest Firecracker release that firework supports.
+var MinFirecrackerVersion = Version{1, 3, 3}
+
+// Environment variables that override the binary paths in the config.
+const (
+	FirecrackerBinEnv = "FIRECRACKER_BIN"
+	JailerBinEnv      = "JAILER_BIN"
+)
+
+// Binaries are the resolved Firecracker and jailer binaries. Jailer is empty if jailer mode is off.
+type Binaries struct {
+	Firecracker string
+	Jailer      string
+	Version     Version
+}
+
+type Version [3]int
+
+func (v Version) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v[0], v[1], v[2])
+}
+
+func (v Version) Less(other Version) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}
+
+var versionPattern = regexp.MustCompile(`v(\d+)\.(\d+)\.(\d+)`)
+
+// ProbeVersion runs a Firecracker or jailer binary with --version and parses the version it reports.
+func ProbeVersion(binPath string) (Version, error) {
+	out, err := exec.Command(binPath, "--version").Output()
+	if err != nil {
+		return Version{}, fmt.Errorf("failed to run %s --version: %w", binPath, err)
+	}
+
+	match := versionPattern.FindStringSubmatch(string(out))
+	if match == nil {
+		return Version{}, fmt.Errorf("unexpected output of %s --version: %s", binPath, strings.TrimSpace(string(out)))
+	}
+
+	var v Version
+	for i := range v {
+		v[i], _ = strconv.Atoi(match[i+1])
+	}
+
+	return v, nil
+}
+
+// findBinary resolves a binary from, in order of precedence, a command line flag, an environment
+// variable, the config and $PATH.
+func findBinary(name, flag, env, conf string) (string, error) {
+	for _, path := range []string{flag, os.Getenv(env), conf} {
+		if path != "" {
+			return exec.LookPath(path)
+		}
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s not found in $PATH, install it or set %s or %s_bin in the config", name, env, name)
+	}
+
+	return path, nil
+}
+
+// FindBinaries resolves the Firecracker binary, and the jailer binary in jailer mode, and refuses
+// Firecracker versions older than MinFirecrackerVersion. The jailer must be of the same version.
+func FindBinaries(conf config.Config, firecrackerFlag, jailerFlag string) (Binaries, error) {
+	firecrackerBin, err := findBinary("firecracker", firecrackerFlag, FirecrackerBinEnv, conf.FirecrackerBin)
+	if err != nil {
+		return Binaries{}, err
+	}
+
+	version, err := ProbeVersion(firecrackerBin)
+	if err != nil {
+		return Binaries{}, err
+	}
+
+	if version.Less(MinFirecrackerVersion) {
+		return Binaries{}, fmt.Errorf("firecracker %s at %s is not supported, %s or newer is required", version, firecrackerBin, MinFirecrackerVersion)
+	}
+
+	bins := Binaries{Firecracker: firecrackerBin, Version: version}
+	if conf.Jailer == nil {
+		return bins, nil
+	}
+
+	bins.Jailer, err = findBinary("jailer", jailerFlag, JailerBinEnv, conf.JailerBin)
+	if err != nil {
+		return Binaries{}, err
+	}
+
+	jailerVersion, err := ProbeVersion(bins.Jailer)
+	if err != nil {
+		return Binaries{}, err
+	}
+
+	if jailerVersion != version {
+		return Binaries{}, fmt.Errorf("jailer %s at %s does not match firecracker %s", jailerVersion, bins.Jailer, version)
+	}
+
+	return bins, nil
+}
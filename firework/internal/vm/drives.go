@@ -0,0 +1,65 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// Drive is an additional block device attached after the root and overlay drives.
+type Drive struct {
+	Id         string
+	PathOnHost string
+	ReadOnly   bool
+}
+
+// ReservedDriveId reports whether id is used by the root or overlay drive.
+func ReservedDriveId(id string) bool {
+	return id == rootDriveId || id == overlayDriveId
+}
+
+// Mount asks the guest agent to mount the drive with DriveId at Path.
+type Mount struct {
+	DriveId  string
+	Path     string
+	ReadOnly bool
+}
+
+// GuestMount is a Mount resolved to the block device seen by the guest.
+type GuestMount struct {
+	Device   string `json:"device"`
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// guestDevice returns the name of the virtio block device of the drive at index.
+// Firecracker exposes drives as /dev/vda, /dev/vdb, ... in the order they are attached.
+func guestDevice(index int) string {
+	return fmt.Sprintf("/dev/vd%c", 'a'+index)
+}
+
+// guestMounts resolves the mounts of a machine to guest block devices.
+func (m *Machine) guestMounts() ([]GuestMount, error) {
+	mounts := make([]GuestMount, 0, len(m.guest.Mounts))
+	for _, mount := range m.guest.Mounts {
+		index := -1
+		for i, drive := range m.vmm().Cfg.Drives {
+			if firecracker.StringValue(drive.DriveID) == mount.DriveId {
+				index = i
+				break
+			}
+		}
+
+		if index < 0 {
+			return nil, fmt.Errorf("machine %s has no drive %s to mount at %s", m.name, mount.DriveId, mount.Path)
+		}
+
+		mounts = append(mounts, GuestMount{
+			Device:   guestDevice(index),
+			Path:     mount.Path,
+			ReadOnly: mount.ReadOnly,
+		})
+	}
+
+	return mounts, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"os"
+	"os/exec"
 	"syscall"
 
 	"github.com/firecracker-microvm/firecracker-go-sdk"
@@ -23,16 +24,18 @@ func openFileLogger(vmmLogPath string) (*logrus.Entry, error) {
 	return logrus.NewEntry(logger), nil
 }
 
-func createFirecrackerVM(ctx context.Context, cfg firecracker.Config, stdio io.Writer, binPath, vmmLogPath, socketPath string) (*firecracker.Machine, error) {
+func firecrackerCommand(ctx context.Context, stdio io.Writer, binPath, socketPath string) *exec.Cmd {
 	// Command interface automatically connects stdout/stderr/stdin to /dev/null if not specified.
-	cmd := firecracker.VMCommandBuilder{}.
+	return firecracker.VMCommandBuilder{}.
 		WithSocketPath(socketPath).
 		WithBin(binPath).
 		WithStdout(stdio).
 		WithStderr(stdio).
 		// WithStdin(os.Stdin).
 		Build(ctx)
+}
 
+func createFirecrackerVM(ctx context.Context, cfg firecracker.Config, cmd *exec.Cmd, vmmLogPath string, opts ...firecracker.Opt) (*firecracker.Machine, error) {
 	// Copy parent environment variables to the child process.
 	cmd.Env = os.Environ()
 
@@ -47,10 +50,12 @@ func createFirecrackerVM(ctx context.Context, cfg firecracker.Config, stdio io.W
 		return nil, err
 	}
 
-	m, err := firecracker.NewMachine(ctx, cfg,
+	opts = append([]firecracker.Opt{
 		firecracker.WithProcessRunner(cmd),
 		firecracker.WithLogger(logger),
-	)
+	}, opts...)
+
+	m, err := firecracker.NewMachine(ctx, cfg, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -3,148 +3,362 @@ package vm
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"os"
+	"os/exec"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/dns"
+	"github.com/jlkiri/firework/internal/events"
+	"github.com/jlkiri/firework/internal/state"
 	"golang.org/x/exp/slog"
 	"golang.org/x/sync/errgroup"
 )
 
 type Machine struct {
-	inner *firecracker.Machine
-	name  string
-	cid   uint32
+	// mu guards the VMM, which is replaced when the machine is restarted, and the restart count.
+	mu       sync.Mutex
+	inner    *firecracker.Machine
+	restarts int
+
+	opts    MachineOptions
+	name    string
+	cid     uint32
+	guest   GuestConfig
+	bootCfg BootConfig
+	boot    *bootState
 }
 
-func (m *Machine) Ipv4() string {
-	return m.inner.Cfg.NetworkInterfaces[0].StaticConfiguration.IPConfiguration.IPAddr.String()
+// BootConfig controls when a machine starts, when it counts as ready and whether it is restarted.
+type BootConfig struct {
+	// Probe runs after the agent answered and can be nil.
+	Probe *config.Probe
+	// DependsOn delays the start of the machine until the dependencies meet their conditions.
+	DependsOn []config.Dependency
+	// Restart is one of the config.Restart policies. MaxRestarts of 0 allows unlimited restarts.
+	Restart     string
+	MaxRestarts int
 }
 
-type MachineGroup struct {
-	machines []Machine
-	eg       *errgroup.Group
-	pidTable PidTable
+// GuestConfig is the configuration passed to the guest agent through MMDS.
+type GuestConfig struct {
+	Nameservers   []string
+	SearchDomains []string
+	Metadata      map[string]interface{}
+	UserData      string
+	Mounts        []Mount
+}
+
+func (m *Machine) Ipv4() string {
+	return m.vmm().Cfg.NetworkInterfaces[0].StaticConfiguration.IPConfiguration.IPAddr.String()
 }
 
-type Entry struct {
-	VmId string `json:"vm_id"`
-	Pid  int    `json:"pid"`
+func (m *Machine) ip() net.IP {
+	return m.vmm().Cfg.NetworkInterfaces[0].StaticConfiguration.IPConfiguration.IPAddr.IP
 }
 
-// Machine name -> Entry
-type PidTable map[string]Entry
+type MachineGroup struct {
+	machines []*Machine
+	eg       *errgroup.Group
+	store    *state.Store
+	journal  *events.Journal
+	dns      *dns.Server
+
+	// stop is closed when the group is shut down so that machines are not started or restarted anymore.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// mu guards the started machines, the running members and the generation of the host table
+	// published to them. stop is closed with mu held, so a machine is either started before the
+	// group is shut down and stopped by Shutdown, or not started at all.
+	mu         sync.Mutex
+	started    map[string]*Machine // Machines whose VMM started and did not exit yet
+	members    map[string]*Machine // Started machines that received their metadata
+	generation uint64
+
+	// publishMu serializes joins and leaves, which update the machines through MMDS without holding mu.
+	publishMu sync.Mutex
+}
 
 type Metadata struct {
-	Cid      uint32            `json:"cid"`
-	Ipv4     string            `json:"ipv4"`
-	Hostname string            `json:"hostname"`
-	Hosts    map[string]string `json:"hosts"`
+	Cid           uint32            `json:"cid"`
+	Ipv4          string            `json:"ipv4"`
+	Hostname      string            `json:"hostname"`
+	Hosts         map[string]string `json:"hosts"`
+	Nameservers   []string          `json:"nameservers"`
+	SearchDomains []string          `json:"search_domains"`
+	// Generation increases every time the host table changes so that guests can watch for updates.
+	Generation uint64 `json:"generation"`
+	// User supplied metadata and a script that the agent runs on first boot.
+	UserMetadata map[string]interface{} `json:"metadata"`
+	UserData     string                 `json:"user_data"`
+	// Drives the agent mounts before running user data.
+	Mounts []GuestMount `json:"mounts"`
 }
 
-func NewMachineGroup() *MachineGroup {
+// NewMachineGroup creates an empty machine group. Records of running machines are
+// published to dnsServer, which can be nil if the cluster does not use the built-in DNS server.
+// Lifecycle changes are recorded in store and journal, which can be nil for a group that does not
+// run its machines.
+func NewMachineGroup(dnsServer *dns.Server, store *state.Store, journal *events.Journal) *MachineGroup {
 	return &MachineGroup{
-		machines: make([]Machine, 0),
+		machines: make([]*Machine, 0),
 		eg:       new(errgroup.Group),
-		pidTable: make(PidTable),
+		store:    store,
+		journal:  journal,
+		dns:      dnsServer,
+		stop:     make(chan struct{}),
+		started:  make(map[string]*Machine),
+		members:  make(map[string]*Machine),
 	}
 }
 
 func (mg *MachineGroup) Start(ctx context.Context) error {
-	// Populate hosts map
-	hosts := make(map[string]string)
 	for _, m := range mg.machines {
-		ip, _, err := net.ParseCIDR(m.Ipv4())
-		if err != nil {
-			return err
-		}
+		machine := m
+		mg.eg.Go(func() error {
+			return mg.supervise(ctx, machine)
+		})
+	}
+
+	return nil
+}
+
+// run starts the machine and waits until it exits. A VMM that started is always waited for before
+// run returns, so that it never outlives its machine.
+func (mg *MachineGroup) run(ctx context.Context, machine *Machine) error {
+	machine.boot.mu.Lock()
+	machine.boot.startedAt = time.Now()
+	machine.boot.mu.Unlock()
 
-		hosts[m.name] = ip.String()
+	mg.setState(machine, state.StateStarting)
+
+	inner := machine.vmm()
+	if err := inner.Start(ctx); err != nil {
+		// The machine never booted, e.g. because of a bad kernel, drive or TAP device.
+		mg.emitExited(machine, exitCode(err), err, "start")
+		return err
 	}
 
-	for _, m := range mg.machines {
-		machine := m
-		mg.eg.Go(func() error {
-			if err := machine.inner.Start(ctx); err != nil {
-				return err
-			}
+	if !mg.track(machine) {
+		// The group was shut down while the VMM was starting.
+		return mg.abort(ctx, machine, nil, "start")
+	}
+	defer mg.untrack(machine)
 
-			meta, err := createMetadata(Metadata{
-				Cid:      machine.cid,
-				Ipv4:     machine.Ipv4(),
-				Hostname: machine.name,
-				Hosts:    hosts,
-			})
-			if err != nil {
-				return err
-			}
+	machine.boot.markStarted()
 
-			if err := machine.inner.SetMetadata(ctx, meta); err != nil {
-				return err
-			}
+	pid, err := inner.PID()
+	if err != nil {
+		return mg.abort(ctx, machine, err, "start")
+	}
 
-			pid, err := machine.inner.PID()
-			if err != nil {
-				return err
-			}
+	vmId := inner.Cfg.VMID
+	slog.Debug("Machine started with", "name", machine.name, "vmId", vmId, "pid", pid)
 
-			vmId := machine.inner.Cfg.VMID
-			slog.Debug("Machine started with", "name", machine.name, "vmId", vmId, "pid", pid)
+	// Recorded before the readiness checks start so that running never replaces ready.
+	if err := mg.setRunning(machine, pid); err != nil {
+		return mg.abort(ctx, machine, err, "start")
+	}
+	mg.emit(machine, events.Booted, map[string]interface{}{"pid": pid})
 
-			mg.pidTable[machine.name] = Entry{
-				VmId: vmId,
-				Pid:  pid,
-			}
+	if err := mg.join(ctx, machine); err != nil {
+		return mg.abort(ctx, machine, err, "join")
+	}
+	defer mg.leave(ctx, machine)
 
-			if err := mg.updatePidTable(); err != nil {
-				return err
-			}
+	readyCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go mg.watchReady(readyCtx, machine)
 
-			if err := machine.inner.Wait(ctx); err != nil {
-				return err
-			}
+	err = inner.Wait(ctx)
+	mg.emitExited(machine, exitCode(err), err, "")
+	return err
+}
 
-			return nil
-		})
+// track records that the VMM of a machine started, unless the group is being shut down.
+func (mg *MachineGroup) track(machine *Machine) bool {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	if mg.stopping() {
+		return false
 	}
 
-	return nil
+	mg.started[machine.name] = machine
+	return true
+}
+
+func (mg *MachineGroup) untrack(machine *Machine) {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	delete(mg.started, machine.name)
 }
 
-func (mg *MachineGroup) updatePidTable() error {
-	// Update the pid table file and create if it does not exist
-	bytes, err := json.Marshal(mg.pidTable)
+// abort kills the started VMM of a machine that cannot run and waits until it exited. It returns err.
+// stage is the step of run that failed.
+func (mg *MachineGroup) abort(ctx context.Context, machine *Machine, err error, stage string) error {
+	inner := machine.vmm()
+	if stopErr := inner.StopVMM(); stopErr != nil {
+		slog.Error("Failed to stop VMM", "name", machine.name, "error", stopErr)
+	}
+
+	// The VMM was killed, so its exit status says nothing about the machine.
+	_ = inner.Wait(ctx)
+	mg.emitExited(machine, -1, err, stage)
+	return err
+}
+
+// emit records a lifecycle event of a machine in the journal.
+func (mg *MachineGroup) emit(machine *Machine, typ string, details map[string]interface{}) {
+	mg.journal.Emit(events.Event{
+		Type:    typ,
+		Machine: machine.name,
+		VmId:    machine.opts.Id,
+		Details: details,
+	})
+}
+
+// emitExited records that the VMM of a machine exited with code and err. stage is the step of run
+// that failed if the machine did not run until its VMM exited.
+func (mg *MachineGroup) emitExited(machine *Machine, code int, err error, stage string) {
+	e := events.Event{
+		Type:     events.Exited,
+		Machine:  machine.name,
+		VmId:     machine.opts.Id,
+		ExitCode: &code,
+	}
 	if err != nil {
-		return err
+		e.Error = err.Error()
+	}
+	if stage != "" {
+		e.Details = map[string]interface{}{"stage": stage}
 	}
 
-	pidTablePath := config.PidTablePath()
-	if err := os.WriteFile(pidTablePath, bytes, 0644); err != nil {
-		return err
+	mg.journal.Emit(e)
+}
+
+// exitCode returns the exit code of a VMM from the error it exited with, or -1 if it was killed
+// by a signal or did not exit on its own.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
 	}
 
-	return nil
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	return -1
+}
+
+// setRunning records the PID and restart count of a machine whose VMM started.
+func (mg *MachineGroup) setRunning(machine *Machine, pid int) error {
+	if mg.store == nil {
+		return nil
+	}
+
+	return mg.store.SetRunning(machine.name, pid, machine.restartCount())
+}
+
+// setState records a lifecycle transition of a machine. Failures are only logged because the
+// machine is not affected by them.
+func (mg *MachineGroup) setState(machine *Machine, s string) {
+	if mg.store == nil {
+		return
+	}
+
+	if err := mg.store.SetState(machine.name, s); err != nil {
+		slog.Error("Failed to record machine state", "name", machine.name, "state", s, "error", err)
+	}
 }
 
 func (mg *MachineGroup) Wait(ctx context.Context) error {
 	return mg.eg.Wait()
 }
 
+// ShutdownTimeout is how long machines get to shut down after CtrlAltDel before they are killed.
+const ShutdownTimeout = 20 * time.Second
+
+// Shutdown stops all started machines. Machines that are waiting for their dependencies or to be
+// restarted are not started anymore, and machines whose VMM is still starting are stopped as soon
+// as it started. Machines that did not exit within ShutdownTimeout are killed.
 func (mg *MachineGroup) Shutdown(ctx context.Context) error {
-	for _, m := range mg.machines {
-		if err := m.inner.Shutdown(ctx); err != nil {
-			return err
+	running := mg.stopStarting()
+	time.AfterFunc(ShutdownTimeout, mg.Kill)
+
+	var errs []error
+	for _, m := range running {
+		// A paused guest does not react to CtrlAltDel.
+		if err := m.vmm().ResumeVM(ctx); err != nil {
+			slog.Debug("Failed to resume machine before shutdown", "name", m.name, "error", err)
+		}
+
+		if err := m.vmm().Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to shut down %s: %w", m.name, err))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// stopStarting keeps machines from being started or restarted and returns the started ones.
+func (mg *MachineGroup) stopStarting() []*Machine {
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+
+	mg.stopOnce.Do(func() { close(mg.stop) })
+	running := make([]*Machine, 0, len(mg.started))
+	for _, m := range mg.started {
+		running = append(running, m)
+	}
+
+	return running
+}
+
+// Kill stops the group like Shutdown but kills the VMMs instead of asking the guests to shut down.
+func (mg *MachineGroup) Kill() {
+	running := mg.stopStarting()
+
+	for _, m := range running {
+		if err := m.vmm().StopVMM(); err != nil {
+			slog.Error("Failed to kill VMM", "name", m.name, "error", err)
+		}
+	}
 }
 
-func (mg *MachineGroup) AddMachine(machine *firecracker.Machine, name string, cid uint32) error {
-	mg.machines = append(mg.machines, Machine{machine, name, cid})
+// AddMachine creates a machine from opts and adds it to the group. The options are kept to
+// recreate the machine in place when it is restarted.
+func (mg *MachineGroup) AddMachine(ctx context.Context, opts MachineOptions, name string, guest GuestConfig, bootCfg BootConfig) error {
+	inner, err := CreateMachine(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	machine := &Machine{
+		inner:   inner,
+		opts:    opts,
+		name:    name,
+		cid:     opts.Cid,
+		guest:   guest,
+		bootCfg: bootCfg,
+		boot:    newBootState(),
+	}
+	mg.machines = append(mg.machines, machine)
+
+	mg.emit(machine, events.Created, map[string]interface{}{
+		"ipv4": machine.Ipv4(),
+		"tap":  opts.IpConfig.TapDevice,
+		"cid":  opts.Cid,
+	})
 	return nil
 }
 
@@ -163,23 +377,36 @@ func createMetadata(metadata Metadata) (map[string]interface{}, error) {
 	return apiMetadata, nil
 }
 
+// InstallSignalHandlers shuts the group down on the first SIGTERM or SIGINT. Machines that do
+// not shut down in time are killed on the next one.
 func InstallSignalHandlers(ctx context.Context, mg *MachineGroup) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 
 	go func() {
+		defer signal.Stop(c)
+
+		shuttingDown := false
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case sig := <-c:
-				slog.Info("Caught signal: %s, requesting clean shutdown", sig.String())
-				if sig == syscall.SIGTERM || sig == os.Interrupt {
-					if err := mg.Shutdown(ctx); err != nil {
-						slog.Error("an error occurred while shutting down Firecracker VMM", err)
-					}
+				if sig != syscall.SIGTERM && sig != os.Interrupt {
+					continue
+				}
+
+				if shuttingDown {
+					slog.Warn("Caught signal again, killing machines", "signal", sig.String())
+					mg.Kill()
 					return
 				}
+
+				slog.Info("Caught signal, requesting clean shutdown", "signal", sig.String())
+				shuttingDown = true
+				if err := mg.Shutdown(ctx); err != nil {
+					slog.Error("an error occurred while shutting down Firecracker VMM", "error", err)
+				}
 			}
 		}
 	}()
@@ -0,0 +1,226 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/jlkiri/firework/internal/config"
+	"golang.org/x/sys/unix"
+)
+
+// Paths of the API and vsock sockets inside the chroot of a jailed machine.
+const (
+	jailedSocketPath = "/firecracker.sock"
+	jailedVsockPath  = "/vsock.sock"
+)
+
+const linkJailFilesHandlerName = "firework.LinkJailFiles"
+
+// jailRoot is the chroot of a jailed machine. The jailer creates it as <base>/<exec file name>/<id>/root.
+func jailRoot(execFile, vmId string) string {
+	return filepath.Join(config.JailerDir, filepath.Base(execFile), vmId, "root")
+}
+
+func jailerConfig(jailer *config.Jailer, vmId, execFile, jailerBin, kernelPath string, stdio io.Writer) *firecracker.JailerConfig {
+	return &firecracker.JailerConfig{
+		UID:            firecracker.Int(jailer.Uid),
+		GID:            firecracker.Int(jailer.Gid),
+		ID:             vmId,
+		NumaNode:       firecracker.Int(0),
+		ExecFile:       execFile,
+		JailerBinary:   jailerBin,
+		ChrootBaseDir:  config.JailerDir,
+		ChrootStrategy: jailStrategy{kernelPath: kernelPath, jailer: jailer},
+		CgroupVersion:  jailer.CgroupVersion,
+		Stdout:         stdio,
+		Stderr:         stdio,
+	}
+}
+
+// jailerCommand builds the jailer command like the SDK does but with extra cgroups,
+// which the SDK does not support.
+func jailerCommand(ctx context.Context, jailer *config.Jailer, cfg *firecracker.JailerConfig) *exec.Cmd {
+	builder := firecracker.NewJailerCommandBuilder().
+		WithBin(cfg.JailerBinary).
+		WithID(cfg.ID).
+		WithUID(*cfg.UID).
+		WithGID(*cfg.GID).
+		WithNumaNode(*cfg.NumaNode).
+		WithExecFile(cfg.ExecFile).
+		WithChrootBaseDir(cfg.ChrootBaseDir).
+		WithCgroupVersion(cfg.CgroupVersion).
+		WithStdout(cfg.Stdout).
+		WithStderr(cfg.Stderr)
+
+	if jailer.NetNS != "" {
+		builder = builder.WithNetNS(jailer.NetNS)
+	}
+
+	args := builder.Args()
+	for _, cgroup := range jailer.Cgroups {
+		args = append(args, "--cgroup", cgroup)
+	}
+	args = append(args, "--", "--api-sock", jailedSocketPath)
+
+	cmd := exec.CommandContext(ctx, builder.Bin(), args...)
+	cmd.Stdout = builder.Stdout()
+	cmd.Stderr = builder.Stderr()
+
+	return cmd
+}
+
+// jailStrategy puts the kernel, drives and log fifos into the chroot of a jailed machine. Unlike
+// the naive strategy of the SDK, it never changes the owner of a file that is shared with the host,
+// names drives after their IDs so that drives with the same file name do not collide, and copies
+// read-only drives that cannot be hard-linked because they are on another filesystem.
+type jailStrategy struct {
+	kernelPath string
+	jailer     *config.Jailer
+}
+
+func (s jailStrategy) AdaptHandlers(handlers *firecracker.Handlers) error {
+	if !handlers.FcInit.Has(firecracker.CreateLogFilesHandlerName) {
+		return firecracker.ErrRequiredHandlerMissing
+	}
+
+	handlers.FcInit = handlers.FcInit.AppendAfter(firecracker.CreateLogFilesHandlerName, firecracker.Handler{
+		Name: linkJailFilesHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return s.linkFiles(&m.Cfg)
+		},
+	})
+
+	return nil
+}
+
+// linkFiles links the files of cfg into the chroot and rewrites their paths to paths inside it.
+func (s jailStrategy) linkFiles(cfg *firecracker.Config) error {
+	root := jailRoot(cfg.JailerCfg.ExecFile, cfg.JailerCfg.ID)
+
+	kernel := filepath.Base(s.kernelPath)
+	if err := linkOrCopy(s.kernelPath, filepath.Join(root, kernel)); err != nil {
+		return err
+	}
+	cfg.KernelImagePath = kernel
+
+	for i, drive := range cfg.Drives {
+		hostPath := firecracker.StringValue(drive.PathOnHost)
+		name := "drive-" + firecracker.StringValue(drive.DriveID)
+		jailedPath := filepath.Join(root, name)
+
+		if firecracker.BoolValue(drive.IsReadOnly) {
+			if err := linkOrCopy(hostPath, jailedPath); err != nil {
+				return err
+			}
+		} else {
+			// CheckJailedDrives ensures that writable drives are on the same filesystem.
+			if err := os.Link(hostPath, jailedPath); err != nil {
+				return err
+			}
+
+			// The overlay drive is created for this machine only, so it can be handed over to the
+			// jailed user. Other writable drives must already be writable by it.
+			if firecracker.StringValue(drive.DriveID) == overlayDriveId {
+				if err := os.Chown(jailedPath, s.jailer.Uid, s.jailer.Gid); err != nil {
+					return err
+				}
+			}
+		}
+
+		cfg.Drives[i].PathOnHost = firecracker.String(name)
+	}
+
+	// The fifos are created for this machine only.
+	for _, fifoPath := range []*string{&cfg.LogFifo, &cfg.MetricsFifo} {
+		if *fifoPath == "" {
+			continue
+		}
+
+		name := filepath.Base(*fifoPath)
+		if err := os.Link(*fifoPath, filepath.Join(root, name)); err != nil {
+			return err
+		}
+		if err := os.Chown(filepath.Join(root, name), s.jailer.Uid, s.jailer.Gid); err != nil {
+			return err
+		}
+		*fifoPath = name
+	}
+
+	return nil
+}
+
+// linkOrCopy hard links src to dst, or copies it if they are on different filesystems.
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if !errors.Is(err, unix.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// CheckJailedDrives ensures that the writable drives of a jailed machine can be hard-linked into
+// its chroot and are writable by the jailed user, because firework does not change the owner of
+// files that are shared with the host.
+func CheckJailedDrives(jailer *config.Jailer, drives []Drive) error {
+	var dataDir unix.Stat_t
+	if err := unix.Stat(config.DataDir, &dataDir); err != nil {
+		return err
+	}
+
+	for _, drive := range drives {
+		if drive.ReadOnly {
+			continue
+		}
+
+		var stat unix.Stat_t
+		if err := unix.Stat(drive.PathOnHost, &stat); err != nil {
+			return fmt.Errorf("drive %s: %w", drive.Id, err)
+		}
+
+		if stat.Dev != dataDir.Dev {
+			return fmt.Errorf("drive %s: %s must be on the same filesystem as %s to be attached read-write in jailer mode", drive.Id, drive.PathOnHost, config.DataDir)
+		}
+
+		writable := (int(stat.Uid) == jailer.Uid && stat.Mode&unix.S_IWUSR != 0) ||
+			(int(stat.Gid) == jailer.Gid && stat.Mode&unix.S_IWGRP != 0) ||
+			stat.Mode&unix.S_IWOTH != 0
+		if !writable {
+			return fmt.Errorf("drive %s: %s must be writable by uid %d or gid %d to be attached read-write in jailer mode", drive.Id, drive.PathOnHost, jailer.Uid, jailer.Gid)
+		}
+	}
+
+	return nil
+}
+
+// linkSockets links the sockets of a jailed machine to the paths they have for machines that are
+// not jailed, so that other commands find them without knowing about the jail.
+func linkSockets(root, socketPath, vsockPath string) error {
+	if err := os.Symlink(filepath.Join(root, jailedSocketPath), socketPath); err != nil {
+		return err
+	}
+
+	return os.Symlink(filepath.Join(root, jailedVsockPath), vsockPath)
+}
@@ -0,0 +1,83 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+// ReadMachines returns the records of the machines of the cluster from the state store.
+func ReadMachines() ([]state.Machine, error) {
+	store, err := state.OpenExisting(config.DbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	return store.List()
+}
+
+// QueryTimeout bounds the time a command spends on the API socket of a single machine.
+const QueryTimeout = 5 * time.Second
+
+// OverlayDrive returns the path of the overlay drive of a machine, or "" if it has none.
+func OverlayDrive(vmId string) string {
+	path := config.OverlayDrivePath(vmId)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+
+	return path
+}
+
+// Connect returns a handle to an already running machine through its API socket.
+// The handle cannot be started, only queried and updated.
+func Connect(ctx context.Context, vmId string) (*firecracker.Machine, error) {
+	socketPath := config.SocketPath(vmId)
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil, fmt.Errorf("machine %s is not running: %w", vmId, err)
+	}
+
+	return firecracker.NewMachine(ctx, firecracker.Config{
+		SocketPath: socketPath,
+	}, firecracker.WithLogger(logrus.NewEntry(logrus.StandardLogger())))
+}
+
+// ConnectByName looks up a machine by its node name in the state store and connects to it.
+func ConnectByName(ctx context.Context, name string) (*firecracker.Machine, state.Machine, error) {
+	store, err := state.OpenExisting(config.DbPath)
+	if err != nil {
+		return nil, state.Machine{}, err
+	}
+	defer store.Close()
+
+	record, err := store.Get(name)
+	if err != nil {
+		return nil, state.Machine{}, err
+	}
+
+	m, err := Connect(ctx, record.VmId)
+	if err != nil {
+		return nil, state.Machine{}, err
+	}
+
+	return m, record, nil
+}
+
+// ExportConfig returns the full configuration of a running machine as reported by Firecracker.
+func ExportConfig(m *firecracker.Machine) (*models.FullVMConfiguration, error) {
+	client := firecracker.NewClient(m.Cfg.SocketPath, m.Logger(), false)
+	resp, err := client.GetExportVMConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Payload, nil
+}
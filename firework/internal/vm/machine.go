@@ -2,12 +2,19 @@ package vm
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"os"
 
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/jlkiri/firework/internal/config"
+)
+
+const (
+	rootDriveId    = "root"
+	overlayDriveId = "overlayfs"
 )
 
 // The file at VmmLogPath and InstanceFifoLogWriter are the same thing by design
@@ -22,19 +29,28 @@ type MachineOptions struct {
 	MetricsFifoPath       string
 	VsockPath             string
 	InitrdPath            string
-	OverlayDrivePath      string
+	OverlayDrivePath      string // Empty for a ram overlay
 	VmmLogPath            string
 	Id                    string
 	Cid                   uint32
 	Memory                int64
 	Vcpu                  int64
 	IpConfig              *machineIpConfig
+	RateLimits            config.RateLimits
+	Drives                []Drive
+	Balloon               *config.Balloon
+	Jailer                *config.Jailer // Set to run Firecracker through the jailer
+	Binaries              Binaries
+	// Set to restore the machine from a snapshot instead of booting it.
+	SnapshotMemPath   string
+	SnapshotStatePath string
 }
 
 type machineIpConfig struct {
-	GatewayIp net.IP
-	IpAddr    net.IPNet // The IP field of IPNet must be an actual IP and not the network number
-	TapDevice string
+	GatewayIp   net.IP
+	IpAddr      net.IPNet // The IP field of IPNet must be an actual IP and not the network number
+	TapDevice   string
+	Nameservers []string
 }
 
 func CreateMachine(ctx context.Context, opts MachineOptions) (*firecracker.Machine, error) {
@@ -43,6 +59,12 @@ func CreateMachine(ctx context.Context, opts MachineOptions) (*firecracker.Machi
 		return nil, err
 	}
 
+	// The kernel only configures the first 2 nameservers. The full list is passed to the guest through MMDS.
+	nameservers := opts.IpConfig.Nameservers
+	if len(nameservers) > 2 {
+		nameservers = nameservers[:2]
+	}
+
 	networkInterface := firecracker.NetworkInterface{
 		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
 			HostDevName: opts.IpConfig.TapDevice,
@@ -51,36 +73,67 @@ func CreateMachine(ctx context.Context, opts MachineOptions) (*firecracker.Machi
 				IfName:      "eth0",
 				IPAddr:      opts.IpConfig.IpAddr,
 				Gateway:     opts.IpConfig.GatewayIp,
-				Nameservers: []string{"8.8.8.8"},
+				Nameservers: nameservers,
 			},
 		},
-		AllowMMDS: true,
+		AllowMMDS:      true,
+		InRateLimiter:  newRateLimiter(opts.RateLimits.NetworkIn),
+		OutRateLimiter: newRateLimiter(opts.RateLimits.NetworkOut),
+	}
+
+	// Firecracker has no limiter shared by drives, so a limiter on every drive would multiply the
+	// limit by the number of drives. The disk limit applies to the root filesystem instead, which
+	// is written to the overlay drive.
+	diskRateLimiter := newRateLimiter(opts.RateLimits.Disk)
+	rootRateLimiter := diskRateLimiter
+	if opts.OverlayDrivePath != "" {
+		rootRateLimiter = nil
+	}
+
+	drives := []models.Drive{
+		{
+			DriveID:      firecracker.String(rootDriveId),
+			IsRootDevice: firecracker.Bool(true),
+			// The jailed user cannot open the shared root image for writing. It is a squashfs anyway.
+			IsReadOnly:  firecracker.Bool(opts.Jailer != nil),
+			PathOnHost:  firecracker.String(opts.RootFsPath),
+			RateLimiter: rootRateLimiter,
+		},
+	}
+
+	// overlay-init mounts a tmpfs when overlay_root is "ram". Otherwise it mounts the given block device,
+	// which is vdb because the overlay drive is attached right after the root drive.
+	overlayRoot := "ram"
+	if opts.OverlayDrivePath != "" {
+		overlayRoot = "vdb"
+		drives = append(drives, models.Drive{
+			DriveID:      firecracker.String(overlayDriveId),
+			IsRootDevice: firecracker.Bool(false),
+			IsReadOnly:   firecracker.Bool(false),
+			PathOnHost:   firecracker.String(opts.OverlayDrivePath),
+			RateLimiter:  diskRateLimiter,
+		})
+	}
+
+	for _, drive := range opts.Drives {
+		drives = append(drives, models.Drive{
+			DriveID:      firecracker.String(drive.Id),
+			IsRootDevice: firecracker.Bool(false),
+			IsReadOnly:   firecracker.Bool(drive.ReadOnly),
+			PathOnHost:   firecracker.String(drive.PathOnHost),
+		})
 	}
 
 	cfg := firecracker.Config{
 		SocketPath:      opts.SocketPath,
 		KernelImagePath: opts.KernelImagePath,
-		KernelArgs:      "console=ttyS0 noapic reboot=k panic=1 pci=off overlay_root=vdb i8042.noaux i8042.nomux i8042.nopnp i8042.dumbkbd init=/sbin/overlay-init",
-		// KernelArgs: "noapic reboot=k panic=1 pci=off overlay_root=vdb i8042.noaux i8042.nomux i8042.nopnp i8042.dumbkbd init=/sbin/overlay-init",
+		KernelArgs:      fmt.Sprintf("console=ttyS0 noapic reboot=k panic=1 pci=off overlay_root=%s i8042.noaux i8042.nomux i8042.nopnp i8042.dumbkbd init=/sbin/overlay-init", overlayRoot),
 		MachineCfg: models.MachineConfiguration{
 			VcpuCount:  firecracker.Int64(opts.Vcpu),
 			MemSizeMib: firecracker.Int64(opts.Memory),
 			Smt:        firecracker.Bool(false),
 		},
-		Drives: []models.Drive{
-			{
-				DriveID:      firecracker.String("root"),
-				IsRootDevice: firecracker.Bool(true),
-				IsReadOnly:   firecracker.Bool(false),
-				PathOnHost:   firecracker.String(opts.RootFsPath),
-			},
-			{
-				DriveID:      firecracker.String("overlayfs"),
-				IsRootDevice: firecracker.Bool(false),
-				IsReadOnly:   firecracker.Bool(false),
-				PathOnHost:   firecracker.String("/dev/sdb1"),
-			},
-		},
+		Drives:        drives,
 		FifoLogWriter: opts.InstanceFifoLogWriter,
 		LogFifo:       opts.InstanceLogFifoPath,
 		MetricsFifo:   opts.MetricsFifoPath,
@@ -97,22 +150,56 @@ func CreateMachine(ctx context.Context, opts MachineOptions) (*firecracker.Machi
 		NetworkInterfaces: []firecracker.NetworkInterface{networkInterface},
 	}
 
-	machine, err := createFirecrackerVM(
-		ctx,
-		cfg,
-		opts.Stdio,
-		"/bin/firecracker",
-		opts.VmmLogPath,
-		opts.SocketPath,
-	)
+	binPath := opts.Binaries.Firecracker
+	cmd := firecrackerCommand(ctx, opts.Stdio, binPath, opts.SocketPath)
+
+	if opts.Jailer != nil {
+		// Paths inside the chroot. The SDK resolves the API socket through the jail root.
+		cfg.SocketPath = jailedSocketPath
+		cfg.VsockDevices[0].Path = jailedVsockPath
+		cfg.NetNS = opts.Jailer.NetNS
+		cfg.JailerCfg = jailerConfig(opts.Jailer, opts.Id, binPath, opts.Binaries.Jailer, opts.KernelImagePath, opts.Stdio)
+		cmd = jailerCommand(ctx, opts.Jailer, cfg.JailerCfg)
+	}
+
+	machineOpts := []firecracker.Opt{}
+	if opts.SnapshotMemPath != "" {
+		// The snapshot already contains the vsock device. The SDK would try to add it again after loading.
+		cfg.VsockDevices = nil
+		machineOpts = append(machineOpts, firecracker.WithSnapshot(opts.SnapshotMemPath, opts.SnapshotStatePath, func(sc *firecracker.SnapshotConfig) {
+			sc.ResumeVM = true
+		}))
+	}
+
+	machine, err := createFirecrackerVM(ctx, cfg, cmd, opts.VmmLogPath, machineOpts...)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.Jailer != nil {
+		if err := linkSockets(jailRoot(binPath, opts.Id), opts.SocketPath, opts.VsockPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// A balloon must be created before boot. A restored machine already has it in its snapshot.
+	if opts.Balloon != nil && opts.SnapshotMemPath == "" {
+		balloon := *opts.Balloon
+		machine.Handlers.FcInit = machine.Handlers.FcInit.AppendAfter(
+			firecracker.CreateMachineHandlerName,
+			firecracker.Handler{
+				Name: firecracker.CreateBalloonHandlerName,
+				Fn: func(ctx context.Context, m *firecracker.Machine) error {
+					return m.CreateBalloon(ctx, balloon.AmountMib, balloon.DeflateOnOom, balloon.StatsIntervalS)
+				},
+			},
+		)
+	}
+
 	return machine, nil
 }
 
-func NewMachineIpConfig(gatewayIp net.IP, ipAddr string, tapDevice string) (*machineIpConfig, error) {
+func NewMachineIpConfig(gatewayIp net.IP, ipAddr string, tapDevice string, nameservers []string) (*machineIpConfig, error) {
 	ip, ipnet, err := net.ParseCIDR(ipAddr)
 	if err != nil {
 		return nil, err
@@ -124,6 +211,7 @@ func NewMachineIpConfig(gatewayIp net.IP, ipAddr string, tapDevice string) (*mac
 			IP:   ip,
 			Mask: ipnet.Mask,
 		},
-		TapDevice: tapDevice,
+		TapDevice:   tapDevice,
+		Nameservers: nameservers,
 	}, nil
 }
@@ -0,0 +1,179 @@
+package vm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jlkiri/firework/internal/events"
+	"golang.org/x/exp/slog"
+)
+
+// hostsPatch builds the hosts map of running machines. Machines of the group that are not running
+// are set to nil so that the JSON merge patch applied by MMDS removes them from the guest's view.
+// Must be called with mg.mu held.
+func (mg *MachineGroup) hostsPatch() map[string]interface{} {
+	hosts := make(map[string]interface{}, len(mg.machines))
+	for _, m := range mg.machines {
+		if member, ok := mg.members[m.name]; ok {
+			hosts[m.name] = member.ip().String()
+		} else {
+			hosts[m.name] = nil
+		}
+	}
+
+	return hosts
+}
+
+// runningHosts returns the hosts map of running machines. Must be called with mg.mu held.
+func (mg *MachineGroup) runningHosts() map[string]string {
+	hosts := make(map[string]string, len(mg.members))
+	for name, m := range mg.members {
+		hosts[name] = m.ip().String()
+	}
+
+	return hosts
+}
+
+// metadataTimeout bounds every MMDS update, so that a machine that does not answer on its API
+// socket does not hold up the rest of the group.
+const metadataTimeout = 5 * time.Second
+
+// join makes a started machine visible to the rest of the group. The new machine receives its full
+// metadata and every other running machine receives the updated host table. The machine only
+// becomes a member once it received its metadata.
+func (mg *MachineGroup) join(ctx context.Context, machine *Machine) error {
+	mg.publishMu.Lock()
+	defer mg.publishMu.Unlock()
+
+	mounts, err := machine.guestMounts()
+	if err != nil {
+		return err
+	}
+
+	// Membership only changes with publishMu held, so the host table cannot change until the
+	// machine is a member.
+	mg.mu.Lock()
+	hosts := mg.runningHosts()
+	generation := mg.generation + 1
+	mg.mu.Unlock()
+	hosts[machine.name] = machine.ip().String()
+
+	meta, err := createMetadata(Metadata{
+		Cid:           machine.cid,
+		Ipv4:          machine.Ipv4(),
+		Hostname:      machine.name,
+		Hosts:         hosts,
+		Nameservers:   machine.guest.Nameservers,
+		SearchDomains: machine.guest.SearchDomains,
+		Generation:    generation,
+		UserMetadata:  machine.guest.Metadata,
+		UserData:      machine.guest.UserData,
+		Mounts:        mounts,
+	})
+	if err != nil {
+		return err
+	}
+
+	setCtx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+	if err := machine.vmm().SetMetadata(setCtx, meta); err != nil {
+		return err
+	}
+
+	mg.mu.Lock()
+	mg.members[machine.name] = machine
+	mg.generation++
+
+	if mg.dns != nil {
+		mg.dns.SetHost(machine.name, machine.ip())
+	}
+
+	update := mg.hostsUpdate(machine.name)
+	mg.emitNetworkChanged(machine, "joined")
+	mg.mu.Unlock()
+
+	update.publish(ctx)
+	return nil
+}
+
+// leave removes an exited machine from the group and notifies the remaining running machines.
+func (mg *MachineGroup) leave(ctx context.Context, machine *Machine) {
+	mg.publishMu.Lock()
+	defer mg.publishMu.Unlock()
+
+	mg.mu.Lock()
+	delete(mg.members, machine.name)
+	mg.generation++
+
+	if mg.dns != nil {
+		mg.dns.RemoveHost(machine.name)
+	}
+
+	update := mg.hostsUpdate("")
+	mg.emitNetworkChanged(machine, "left")
+	mg.mu.Unlock()
+
+	update.publish(ctx)
+}
+
+// emitNetworkChanged records a change of the host table. Must be called with mg.mu held.
+func (mg *MachineGroup) emitNetworkChanged(machine *Machine, change string) {
+	mg.emit(machine, events.NetworkChanged, map[string]interface{}{
+		"change":     change,
+		"generation": mg.generation,
+		"hosts":      mg.runningHosts(),
+	})
+}
+
+// hostsUpdate is a host table to be sent to the running machines.
+type hostsUpdate struct {
+	generation uint64
+	patch      map[string]interface{}
+	targets    map[string]*Machine
+}
+
+// hostsUpdate takes the current host table and generation for every running machine except skip.
+// Must be called with mg.mu held.
+func (mg *MachineGroup) hostsUpdate(skip string) hostsUpdate {
+	targets := make(map[string]*Machine, len(mg.members))
+	for name, m := range mg.members {
+		if name != skip {
+			targets[name] = m
+		}
+	}
+
+	return hostsUpdate{
+		generation: mg.generation,
+		patch: map[string]interface{}{
+			"hosts":      mg.hostsPatch(),
+			"generation": mg.generation,
+		},
+		targets: targets,
+	}
+}
+
+// publish sends the host table to its targets in parallel. It is called with mg.publishMu held, so that updates
+// arrive in the order of their generations, but not mg.mu, so that a machine that does not answer
+// does not block the group. Failures are logged rather than returned because a machine may exit
+// while being updated.
+func (u hostsUpdate) publish(ctx context.Context) {
+	var wg sync.WaitGroup
+	for name, m := range u.targets {
+		name, m := name, m
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+			defer cancel()
+
+			if err := m.vmm().UpdateMetadata(ctx, u.patch); err != nil {
+				slog.Warn("Failed to update host table", "name", name, "generation", u.generation, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	slog.Debug("Published host table", "generation", u.generation, "members", len(u.targets))
+}
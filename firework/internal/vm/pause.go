@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+)
+
+// AttachMachineGroup connects to the machines of the running cluster, e.g. from a CLI command
+// that runs in a different process than firework start. Machines without an API socket are skipped.
+func AttachMachineGroup(ctx context.Context) (*MachineGroup, error) {
+	records, err := ReadMachines()
+	if err != nil {
+		return nil, err
+	}
+
+	mg := NewMachineGroup(nil, nil, nil)
+	for _, record := range records {
+		m, err := Connect(ctx, record.VmId)
+		if err != nil {
+			continue
+		}
+
+		mg.machines = append(mg.machines, &Machine{inner: m, name: record.Name, boot: newBootState()})
+	}
+
+	return mg, nil
+}
+
+// lookup returns the named machines of the group or all of them if no names are given.
+func (mg *MachineGroup) lookup(names []string) ([]*Machine, error) {
+	if len(names) == 0 {
+		return mg.machines, nil
+	}
+
+	machines := make([]*Machine, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, m := range mg.machines {
+			if m.name == name {
+				machines = append(machines, m)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("no running machine named %s", name)
+		}
+	}
+
+	return machines, nil
+}
+
+// Pause freezes the vCPUs of the named machines, or of all machines if no names are given.
+// A paused machine keeps its memory and devices but does not run until it is resumed.
+func (mg *MachineGroup) Pause(ctx context.Context, names ...string) ([]string, error) {
+	machines, err := mg.lookup(names)
+	if err != nil {
+		return nil, err
+	}
+
+	paused := make([]string, 0, len(machines))
+	for _, m := range machines {
+		if err := m.vmm().PauseVM(ctx); err != nil {
+			return paused, fmt.Errorf("failed to pause %s: %w", m.name, err)
+		}
+
+		paused = append(paused, m.name)
+	}
+
+	return paused, nil
+}
+
+// Resume continues the named machines, or all machines if no names are given.
+func (mg *MachineGroup) Resume(ctx context.Context, names ...string) ([]string, error) {
+	machines, err := mg.lookup(names)
+	if err != nil {
+		return nil, err
+	}
+
+	resumed := make([]string, 0, len(machines))
+	for _, m := range machines {
+		if err := m.vmm().ResumeVM(ctx); err != nil {
+			return resumed, fmt.Errorf("failed to resume %s: %w", m.name, err)
+		}
+
+		resumed = append(resumed, m.name)
+	}
+
+	return resumed, nil
+}
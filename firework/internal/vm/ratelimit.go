@@ -0,0 +1,95 @@
+package vm
+
+import (
+	"context"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+	"github.com/jlkiri/firework/internal/config"
+)
+
+// Firecracker numbers network interfaces starting from 1 in the order they are declared.
+const networkInterfaceId = "1"
+
+func newTokenBucket(tb *config.TokenBucket) *models.TokenBucket {
+	if tb == nil {
+		return nil
+	}
+
+	builder := firecracker.TokenBucketBuilder{}.
+		WithBucketSize(tb.Size).
+		WithRefillDuration(time.Duration(tb.RefillTimeMs) * time.Millisecond)
+
+	if tb.OneTimeBurst > 0 {
+		builder = builder.WithInitialSize(tb.OneTimeBurst)
+	}
+
+	bucket := builder.Build()
+	return &bucket
+}
+
+// newRateLimiter converts a configured rate limiter to the Firecracker model.
+// Buckets that are not configured are left out, which Firecracker treats as
+// unlimited at boot and as unchanged on update.
+func newRateLimiter(rl *config.RateLimiter) *models.RateLimiter {
+	if rl == nil {
+		return nil
+	}
+
+	return &models.RateLimiter{
+		Bandwidth: newTokenBucket(rl.Bandwidth),
+		Ops:       newTokenBucket(rl.Ops),
+	}
+}
+
+// UpdateRateLimits applies the given rate limits to a running machine. Only non-nil limiters are updated.
+func UpdateRateLimits(ctx context.Context, m *firecracker.Machine, limits config.RateLimits) error {
+	in := newRateLimiter(limits.NetworkIn)
+	out := newRateLimiter(limits.NetworkOut)
+
+	if in != nil || out != nil {
+		// The SDK's UpdateGuestNetworkInterfaceRateLimit sends the inbound limiter in place of
+		// the outbound one, so set the request body directly.
+		err := m.UpdateGuestNetworkInterfaceRateLimit(ctx, networkInterfaceId, firecracker.RateLimiterSet{
+			InRateLimiter:  in,
+			OutRateLimiter: out,
+		}, func(params *ops.PatchGuestNetworkInterfaceByIDParams) {
+			params.Body.RxRateLimiter = in
+			params.Body.TxRateLimiter = out
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if disk := newRateLimiter(limits.Disk); disk != nil {
+		// Not every machine has an overlay drive, so ask Firecracker which drives are attached.
+		vmConfig, err := ExportConfig(m)
+		if err != nil {
+			return err
+		}
+
+		err = m.UpdateGuestDrive(ctx, rootFsDriveId(vmConfig.Drives), "", func(params *ops.PatchGuestDriveByIDParams) {
+			params.Body.RateLimiter = disk
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rootFsDriveId returns the drive that the disk limit of a node applies to: the overlay drive that
+// the root filesystem writes to, or the root drive if the overlay is in memory.
+func rootFsDriveId(drives []*models.Drive) string {
+	for _, drive := range drives {
+		if firecracker.StringValue(drive.DriveID) == overlayDriveId {
+			return overlayDriveId
+		}
+	}
+
+	return rootDriveId
+}
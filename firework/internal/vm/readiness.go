@@ -0,0 +1,241 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/vsock"
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/events"
+	"github.com/jlkiri/firework/internal/state"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	probeInterval = 250 * time.Millisecond
+	probeTimeout  = 10 * time.Second
+)
+
+// bootState tracks a machine from start until it is ready. The channels are closed on the first
+// boot and stay closed when the machine is restarted.
+type bootState struct {
+	started chan struct{} // Closed when the VMM started
+	ready   chan struct{} // Closed when the machine is ready
+	exited  chan struct{} // Closed when the machine exited and will not be restarted
+
+	mu        sync.Mutex
+	startedAt time.Time
+	bootTime  time.Duration
+	lastErr   error // Last failed readiness check
+}
+
+func newBootState() *bootState {
+	return &bootState{
+		started: make(chan struct{}),
+		ready:   make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+}
+
+// markStarted and markReady must only be called by the goroutine that runs the machine.
+func (b *bootState) markStarted() {
+	select {
+	case <-b.started:
+	default:
+		close(b.started)
+	}
+}
+
+func (b *bootState) markReady() {
+	select {
+	case <-b.ready:
+	default:
+		close(b.ready)
+	}
+}
+
+func (b *bootState) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastErr = err
+}
+
+// Readiness is the outcome of waiting for a machine to become ready.
+type Readiness struct {
+	Name     string
+	BootTime time.Duration // From start until ready
+	Err      error
+}
+
+// agentRequest sends a request line to the agent over vsock and returns its reply.
+func agentRequest(ctx context.Context, vsockPath, request string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	conn, err := vsock.DialContext(ctx, vsockPath, config.VSOCK_READY_PORT, vsock.WithRetryTimeout(probeInterval))
+	if err != nil {
+		return "", fmt.Errorf("agent not reachable: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s\n", request); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(reply), nil
+}
+
+// checkReady runs the agent handshake and the probe of the node once.
+func (m *Machine) checkReady(ctx context.Context) error {
+	vsockPath := config.VsockPath(m.name)
+
+	reply, err := agentRequest(ctx, vsockPath, "READY")
+	if err != nil {
+		return err
+	}
+	if reply != "OK" {
+		return fmt.Errorf("agent is not ready: %s", reply)
+	}
+
+	probe := m.bootCfg.Probe
+	if probe == nil {
+		return nil
+	}
+
+	if probe.TcpPort != 0 {
+		addr := net.JoinHostPort(m.ip().String(), strconv.Itoa(probe.TcpPort))
+		conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+		if err != nil {
+			return fmt.Errorf("tcp probe failed: %w", err)
+		}
+		conn.Close()
+	}
+
+	if probe.Exec != "" {
+		reply, err := agentRequest(ctx, vsockPath, "EXEC "+probe.Exec)
+		if err != nil {
+			return fmt.Errorf("exec probe failed: %w", err)
+		}
+		if reply != "EXIT 0" {
+			return fmt.Errorf("exec probe failed: %s", reply)
+		}
+	}
+
+	return nil
+}
+
+// watchReady checks the machine until it is ready and then marks it ready.
+// It gives up when ctx is done, which happens when the machine exits.
+func (mg *MachineGroup) watchReady(ctx context.Context, m *Machine) {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		err := m.checkReady(ctx)
+		if err == nil {
+			m.boot.mu.Lock()
+			m.boot.bootTime = time.Since(m.boot.startedAt)
+			m.boot.lastErr = nil
+			m.boot.mu.Unlock()
+
+			m.boot.markReady()
+			mg.setState(m, state.StateReady)
+			mg.emit(m, events.Ready, map[string]interface{}{"boot_time": m.boot.bootTime.String()})
+			slog.Info("Machine is ready", "name", m.name, "boot_time", m.boot.bootTime)
+			return
+		}
+		m.boot.setErr(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForDependencies blocks until the dependencies of the machine meet their conditions.
+// It fails if a dependency exits before that.
+func (mg *MachineGroup) waitForDependencies(ctx context.Context, m *Machine) error {
+	for _, dep := range m.bootCfg.DependsOn {
+		other, err := mg.lookup([]string{dep.Name})
+		if err != nil {
+			return err
+		}
+		boot := other[0].boot
+
+		condition, reached := config.ConditionReady, boot.ready
+		if dep.Condition == config.ConditionStarted {
+			condition, reached = config.ConditionStarted, boot.started
+		}
+
+		slog.Debug("Waiting for dependency", "name", m.name, "dependency", dep.Name, "condition", condition)
+		select {
+		case <-reached:
+		case <-boot.exited:
+			return fmt.Errorf("dependency %s of %s exited before it was %s", dep.Name, m.name, condition)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// WaitReady waits until all machines are ready, one of them exits or ctx is done,
+// and returns the readiness of every machine.
+func (mg *MachineGroup) WaitReady(ctx context.Context) []Readiness {
+	results := make([]Readiness, len(mg.machines))
+
+	var wg sync.WaitGroup
+	for i, m := range mg.machines {
+		i, m := i, m
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = m.waitReady(ctx)
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
+
+func (m *Machine) waitReady(ctx context.Context) Readiness {
+	r := Readiness{Name: m.name}
+
+	select {
+	case <-m.boot.ready:
+		m.boot.mu.Lock()
+		r.BootTime = m.boot.bootTime
+		m.boot.mu.Unlock()
+	case <-m.boot.exited:
+		r.Err = errors.New("exited before it became ready")
+	case <-ctx.Done():
+		m.boot.mu.Lock()
+		r.Err = m.boot.lastErr
+		m.boot.mu.Unlock()
+		if r.Err == nil {
+			r.Err = errors.New("did not start")
+		}
+		r.Err = fmt.Errorf("not ready: %w", r.Err)
+	}
+
+	return r
+}
@@ -0,0 +1,169 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/jlkiri/firework/internal/config"
+	"github.com/jlkiri/firework/internal/events"
+	"github.com/jlkiri/firework/internal/state"
+	"golang.org/x/exp/slog"
+)
+
+// Restarts are delayed by restartBackoffMin, doubling with every restart up to restartBackoffMax.
+const (
+	restartBackoffMin = time.Second
+	restartBackoffMax = 30 * time.Second
+)
+
+func restartBackoff(restarts int) time.Duration {
+	backoff := restartBackoffMin
+	for i := 0; i < restarts && backoff < restartBackoffMax; i++ {
+		backoff *= 2
+	}
+
+	if backoff > restartBackoffMax {
+		return restartBackoffMax
+	}
+	return backoff
+}
+
+// vmm returns the current VMM of the machine, which changes when the machine is restarted.
+func (m *Machine) vmm() *firecracker.Machine {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inner
+}
+
+func (m *Machine) restartCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.restarts
+}
+
+func (mg *MachineGroup) stopping() bool {
+	select {
+	case <-mg.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (mg *MachineGroup) shouldRestart(m *Machine, err error) bool {
+	if mg.stopping() {
+		return false
+	}
+
+	switch m.bootCfg.Restart {
+	case config.RestartAlways:
+		return true
+	case config.RestartOnFailure:
+		return err != nil
+	default:
+		return false
+	}
+}
+
+func (mg *MachineGroup) setExited(m *Machine, err error) {
+	if err != nil {
+		mg.setState(m, state.StateFailed)
+		return
+	}
+	mg.setState(m, state.StateExited)
+}
+
+// supervise runs the machine and restarts it in place according to its restart policy until it
+// exits for good or the group is shut down.
+func (mg *MachineGroup) supervise(ctx context.Context, m *Machine) error {
+	defer close(m.boot.exited)
+
+	if err := mg.waitForDependencies(ctx, m); err != nil {
+		mg.setExited(m, err)
+		mg.emitExited(m, -1, err, "depends_on")
+		return err
+	}
+
+	if mg.stopping() {
+		mg.setExited(m, nil)
+		return nil
+	}
+
+	for {
+		err := mg.run(ctx, m)
+		if !mg.shouldRestart(m, err) {
+			mg.setExited(m, err)
+			return err
+		}
+
+		restarts := m.restartCount()
+
+		if m.bootCfg.MaxRestarts > 0 && restarts >= m.bootCfg.MaxRestarts {
+			slog.Error("Machine exited too often, giving up", "name", m.name, "restarts", restarts, "error", err)
+			mg.setExited(m, err)
+			if err == nil {
+				return nil
+			}
+			return fmt.Errorf("%s failed after %d restarts: %w", m.name, restarts, err)
+		}
+		mg.setState(m, state.StateRestarting)
+
+		backoff := restartBackoff(restarts)
+		slog.Warn("Machine exited, restarting", "name", m.name, "in", backoff, "restarts", restarts+1, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-mg.stop:
+			mg.setExited(m, err)
+			return err
+		case <-ctx.Done():
+			mg.setExited(m, err)
+			return err
+		}
+
+		if err := mg.recreate(ctx, m); err != nil {
+			mg.setExited(m, err)
+			mg.emitExited(m, -1, err, "restart")
+			return fmt.Errorf("failed to restart %s: %w", m.name, err)
+		}
+		mg.emit(m, events.Restarted, map[string]interface{}{"restarts": restarts + 1, "backoff": backoff.String()})
+	}
+}
+
+// recreate replaces the exited VMM of the machine with a new one that has the same ID, IP address,
+// overlay drive and CID.
+func (mg *MachineGroup) recreate(ctx context.Context, m *Machine) error {
+	opts := m.opts
+	// Boot from the overlay drive instead of going back to the state of the snapshot.
+	opts.SnapshotMemPath = ""
+	opts.SnapshotStatePath = ""
+
+	// A crashed VMM leaves its sockets and jail behind.
+	for _, path := range []string{opts.SocketPath, opts.VsockPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if opts.Jailer != nil {
+		if err := os.RemoveAll(filepath.Dir(jailRoot(opts.Binaries.Firecracker, opts.Id))); err != nil {
+			return err
+		}
+	}
+
+	inner, err := CreateMachine(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.inner = inner
+	m.restarts++
+	m.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package volume
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jlkiri/firework/internal/config"
+)
+
+// Formats of volume images. An ext4 volume can be mounted by the guest agent
+// while a raw volume is attached as an unformatted block device.
+const (
+	FormatExt4 = "ext4"
+	FormatRaw  = "raw"
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]*$`)
+
+// Volume is a disk image that lives outside of the VM data directory and survives cluster restarts.
+type Volume struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+	Path   string `json:"path"`
+}
+
+func path(name, format string) string {
+	return filepath.Join(config.VolumesDir, name+"."+format)
+}
+
+// Create creates a sparse volume image of the given size in bytes.
+func Create(name string, size int64, format string) (Volume, error) {
+	if !validName.MatchString(name) {
+		return Volume{}, fmt.Errorf("invalid volume name %q: must contain only letters, digits and '-'", name)
+	}
+
+	if format != FormatExt4 && format != FormatRaw {
+		return Volume{}, fmt.Errorf("invalid volume format %q: must be %s or %s", format, FormatExt4, FormatRaw)
+	}
+
+	if _, err := Get(name); err == nil {
+		return Volume{}, fmt.Errorf("volume %s already exists", name)
+	}
+
+	if err := os.MkdirAll(config.VolumesDir, 0755); err != nil {
+		return Volume{}, err
+	}
+
+	p := path(name, format)
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return Volume{}, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		os.Remove(p)
+		return Volume{}, err
+	}
+
+	if format == FormatExt4 {
+		if out, err := exec.Command("mkfs.ext4", "-q", "-L", name, p).CombinedOutput(); err != nil {
+			os.Remove(p)
+			return Volume{}, fmt.Errorf("failed to format volume %s: %w: %s", name, err, out)
+		}
+	}
+
+	return Volume{Name: name, Format: format, Size: size, Path: p}, nil
+}
+
+// List returns all volumes sorted by name.
+func List() ([]Volume, error) {
+	entries, err := os.ReadDir(config.VolumesDir)
+	if os.IsNotExist(err) {
+		return []Volume{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := make([]Volume, 0, len(entries))
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		format := strings.TrimPrefix(ext, ".")
+		if entry.IsDir() || (format != FormatExt4 && format != FormatRaw) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		volumes = append(volumes, Volume{
+			Name:   strings.TrimSuffix(entry.Name(), ext),
+			Format: format,
+			Size:   info.Size(),
+			Path:   filepath.Join(config.VolumesDir, entry.Name()),
+		})
+	}
+
+	return volumes, nil
+}
+
+func Get(name string) (Volume, error) {
+	for _, format := range []string{FormatExt4, FormatRaw} {
+		p := path(name, format)
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+
+		return Volume{Name: name, Format: format, Size: info.Size(), Path: p}, nil
+	}
+
+	return Volume{}, fmt.Errorf("volume %s does not exist", name)
+}
+
+func Remove(name string) error {
+	v, err := Get(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(v.Path)
+}
+
+// DriveId returns the Firecracker drive ID of a volume. Drive IDs may only contain
+// alphanumeric characters and underscores.
+func DriveId(name string) string {
+	return "vol_" + strings.ReplaceAll(name, "-", "_")
+}
@@ -8,10 +8,13 @@ use std::{env, fs};
 
 use std::fs::File;
 use std::io::{Read, Write};
+use std::os::unix::fs::PermissionsExt;
 use std::os::unix::io::{AsRawFd, FromRawFd};
+use std::path::Path;
 
 use std::process::Command;
 use std::sync::mpsc;
+use std::time::Duration;
 
 use nom::bytes::complete::tag;
 use nom::character::complete::u16;
@@ -30,58 +33,265 @@ struct Metadata {
     ipv4: String,
     hostname: String,
     hosts: HashMap<String, String>,
+    #[serde(default)]
+    nameservers: Vec<String>,
+    #[serde(default)]
+    search_domains: Vec<String>,
+    #[serde(default)]
+    generation: u64,
+    #[serde(default)]
+    metadata: serde_json::Map<String, serde_json::Value>,
+    #[serde(default)]
+    user_data: String,
+    #[serde(default)]
+    mounts: Vec<MountSpec>,
 }
 
-pub fn log_init() {
-    let level = env::var("LOG_FILTER").unwrap_or_else(|_| "fwagent=debug".into());
+#[derive(Deserialize)]
+struct MountSpec {
+    device: String,
+    path: String,
+    #[serde(default)]
+    read_only: bool,
+}
 
-    env_logger::builder()
-        .parse_filters(&level)
-        .write_style(env_logger::WriteStyle::Never)
-        .format_module_path(false)
-        .init();
+fn mount_drive(spec: &MountSpec) -> Result<(), anyhow::Error> {
+    fs::create_dir_all(&spec.path)?;
+
+    let mut cmd = Command::new("mount");
+    if spec.read_only {
+        cmd.args(["-o", "ro"]);
+    }
+
+    let output = cmd.arg(&spec.device).arg(&spec.path).output()?;
+    if !output.status.success() {
+        anyhow::bail!(
+            "mount {} {}: {}",
+            spec.device,
+            spec.path,
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+
+    info!("Mounted {} at {}", spec.device, spec.path);
+    Ok(())
 }
 
-fn main() -> Result<(), anyhow::Error> {
-    log_init();
+// Agent state that persists across reboots of the VM.
+const STATE_DIR: &str = "/var/lib/fwagent";
+const USER_DATA_LOG_PATH: &str = "/var/log/fwagent-user-data.log";
 
-    // Use HTTP client (reqwest) to call Firecracker MMDS endpoint to retrieve metadata that contains the CID for the vsock listener.
-    // First it must call the token endpoint (/latest/api/token) with PUT method and X-metadata-token-ttl-seconds header to issue a session token.
-    // Then the token is used in the X-metadata-token header to make a call to latest/meta-data endpoint.
-    // MMDS IPv4 address: 169.254.169.254
-    let addr = "169.254.169.254";
+// MMDS IPv4 address.
+const MMDS_ADDR: &str = "169.254.169.254";
 
-    // Add route to MMDS.
-    let mut cmd = Command::new("/sbin/ip");
-    cmd.args(["route", "add", addr, "dev", "eth0"]).output()?;
+// Vsock ports of the interactive shell and of readiness checks from firework.
+const SHELL_PORT: u32 = 10000;
+const READY_PORT: u32 = 10001;
 
-    let client = reqwest::blocking::Client::new();
+// How often to poll MMDS for host table updates.
+const HOSTS_POLL_INTERVAL: Duration = Duration::from_secs(2);
+
+// Use HTTP client (reqwest) to call Firecracker MMDS endpoint to retrieve metadata.
+// First it must call the token endpoint (/latest/api/token) with PUT method and X-metadata-token-ttl-seconds header to issue a session token.
+// Then the token is used in the X-metadata-token header to make a call to latest/meta-data endpoint.
+fn fetch_metadata(client: &reqwest::blocking::Client) -> Result<Metadata, anyhow::Error> {
     let token = client
-        .put(&format!("http://{}/latest/api/token", addr))
+        .put(&format!("http://{}/latest/api/token", MMDS_ADDR))
         .header("X-metadata-token-ttl-seconds", "21600")
         .send()?
         .text()?;
 
-    debug!("X-metadata-token: {}", token);
-
     let metadata = client
-        .get(&format!("http://{}", addr))
+        .get(&format!("http://{}", MMDS_ADDR))
         .header("X-metadata-token", token)
         .header("Accept", "application/json")
         .send()?
         .json::<Metadata>()?;
 
-    let hosts_string = metadata
-        .hosts
+    Ok(metadata)
+}
+
+fn hosts_file(hosts: &HashMap<String, String>) -> String {
+    hosts
         .iter()
         .map(|(k, v)| format!("{} {}", v, k))
         .collect::<Vec<String>>()
-        .join("\n");
+        .join("\n")
+}
+
+// Run the user-data script once per VM, cloud-init style. A marker file records that it already ran.
+// Scripts starting with a shebang are executed directly, others are run with sh.
+fn run_user_data(user_data: &str) -> Result<(), anyhow::Error> {
+    let marker = Path::new(STATE_DIR).join("user-data.done");
+    if user_data.is_empty() || marker.exists() {
+        return Ok(());
+    }
+
+    let script = Path::new(STATE_DIR).join("user-data");
+    fs::write(&script, user_data)?;
+    fs::set_permissions(&script, fs::Permissions::from_mode(0o755))?;
+
+    let mut cmd = if user_data.starts_with("#!") {
+        Command::new(&script)
+    } else {
+        let mut cmd = Command::new("sh");
+        cmd.arg(&script);
+        cmd
+    };
+
+    let log = File::create(USER_DATA_LOG_PATH)?;
+    info!("Running user data, output in {}", USER_DATA_LOG_PATH);
+    let status = cmd.stdout(log.try_clone()?).stderr(log).status()?;
+    info!("User data finished with {}", status);
+
+    fs::write(&marker, status.to_string())?;
+    Ok(())
+}
+
+// Rewrite /etc/hosts whenever firework publishes a different generation of the host table.
+// The generation may also go back, e.g. after the machine was restored from a snapshot.
+fn watch_hosts(mut generation: u64) {
+    let client = reqwest::blocking::Client::new();
+    loop {
+        std::thread::sleep(HOSTS_POLL_INTERVAL);
+
+        let metadata = match fetch_metadata(&client) {
+            Ok(metadata) => metadata,
+            Err(e) => {
+                warn!("Failed to fetch metadata: {}", e);
+                continue;
+            }
+        };
+
+        if metadata.generation == generation {
+            continue;
+        }
+
+        match fs::write("/etc/hosts", hosts_file(&metadata.hosts)) {
+            Ok(()) => {
+                info!("Updated /etc/hosts to generation {}", metadata.generation);
+                generation = metadata.generation;
+            }
+            Err(e) => error!("Failed to update /etc/hosts: {}", e),
+        }
+    }
+}
+
+// Answer readiness checks from firework, one request line per connection. "READY" is answered
+// with "OK" and "EXEC <command>" runs a probe command and is answered with "EXIT <code>".
+fn serve_readiness(cid: u32) -> Result<(), anyhow::Error> {
+    let listener = VsockListener::bind_with_cid_port(cid, READY_PORT)?;
+    for stream in listener.incoming() {
+        match stream {
+            Ok(stream) => {
+                std::thread::spawn(move || {
+                    if let Err(e) = handle_readiness(stream) {
+                        warn!("Failed to handle readiness check: {}", e);
+                    }
+                });
+            }
+            Err(e) => warn!("Bad readiness connection: {}", e),
+        }
+    }
+
+    Ok(())
+}
+
+fn handle_readiness(mut stream: VsockStream) -> Result<(), anyhow::Error> {
+    let mut request = Vec::new();
+    let mut byte = [0u8; 1];
+    while stream.read(&mut byte)? == 1 && byte[0] != b'\n' {
+        request.push(byte[0]);
+    }
+
+    let reply = readiness_reply(&String::from_utf8_lossy(&request), |command| {
+        Command::new("sh")
+            .args(["-c", command])
+            .status()
+            .map(|status| status.code().unwrap_or(-1))
+            .unwrap_or(-1)
+    });
+    stream.write_all(reply.as_bytes())?;
+    Ok(())
+}
+
+fn readiness_reply(request: &str, exec: impl Fn(&str) -> i32) -> String {
+    match request.trim_end() {
+        "READY" => "OK\n".to_string(),
+        request => match request.strip_prefix("EXEC ") {
+            Some(command) => format!("EXIT {}\n", exec(command)),
+            None => "ERROR unknown request\n".to_string(),
+        },
+    }
+}
+
+#[test]
+fn test_readiness_reply() {
+    assert_eq!(readiness_reply("READY", |_| 1), "OK\n");
+    assert_eq!(
+        readiness_reply("EXEC true\r", |c| if c == "true" { 0 } else { 1 }),
+        "EXIT 0\n"
+    );
+    assert_eq!(readiness_reply("HELLO", |_| 0), "ERROR unknown request\n");
+}
+
+fn resolv_conf(nameservers: &[String], search_domains: &[String]) -> String {
+    let mut lines = Vec::new();
+    if !search_domains.is_empty() {
+        lines.push(format!("search {}", search_domains.join(" ")));
+    }
+    for ns in nameservers {
+        lines.push(format!("nameserver {}", ns));
+    }
+    lines.join("\n") + "\n"
+}
+
+#[test]
+fn test_resolv_conf() {
+    assert_eq!(
+        resolv_conf(
+            &["172.18.0.241".to_string(), "10.0.0.1".to_string()],
+            &["default.firework".to_string()]
+        ),
+        "search default.firework\nnameserver 172.18.0.241\nnameserver 10.0.0.1\n"
+    );
+}
+
+pub fn log_init() {
+    let level = env::var("LOG_FILTER").unwrap_or_else(|_| "fwagent=debug".into());
+
+    env_logger::builder()
+        .parse_filters(&level)
+        .write_style(env_logger::WriteStyle::Never)
+        .format_module_path(false)
+        .init();
+}
+
+fn main() -> Result<(), anyhow::Error> {
+    log_init();
+
+    // Add route to MMDS.
+    let mut cmd = Command::new("/sbin/ip");
+    cmd.args(["route", "add", MMDS_ADDR, "dev", "eth0"]).output()?;
+
+    let client = reqwest::blocking::Client::new();
+    let metadata = fetch_metadata(&client)?;
+    let hosts_string = hosts_file(&metadata.hosts);
 
     // Enable packet forwarding and set /etc/hosts.
     fs::write("/proc/sys/net/ipv4/conf/all/forwarding", "1")?;
     fs::write("/etc/hosts", hosts_string)?;
 
+    // /etc/resolv.conf may be a symlink to the read-only /proc/net/pnp written by the kernel,
+    // which only holds the first 2 nameservers and no search domains.
+    if !metadata.nameservers.is_empty() {
+        let _ = fs::remove_file("/etc/resolv.conf");
+        fs::write(
+            "/etc/resolv.conf",
+            resolv_conf(&metadata.nameservers, &metadata.search_domains),
+        )?;
+    }
+
     // Set standard PATH env variable.
     env::set_var(
         "PATH",
@@ -90,6 +300,20 @@ fn main() -> Result<(), anyhow::Error> {
 
     sethostname(metadata.hostname.as_bytes())?;
 
+    // Make user metadata available to scripts without going through MMDS.
+    fs::create_dir_all(STATE_DIR)?;
+    fs::write(
+        Path::new(STATE_DIR).join("metadata.json"),
+        serde_json::to_vec_pretty(&metadata.metadata)?,
+    )?;
+
+    // Mount drives before user data runs so that scripts can rely on them.
+    for spec in &metadata.mounts {
+        if let Err(e) = mount_drive(spec) {
+            error!("Failed to mount drive: {}", e);
+        }
+    }
+
     std::thread::spawn(|| {
         let listener = TcpListener::bind("0.0.0.0:3000").expect("failed to bind");
         let (mut stream, addr) = listener.accept().expect("failed to accept");
@@ -99,7 +323,25 @@ fn main() -> Result<(), anyhow::Error> {
             .expect("failed to respond");
     });
 
-    let listener = VsockListener::bind_with_cid_port(metadata.cid, 10000)?;
+    let generation = metadata.generation;
+    std::thread::spawn(move || watch_hosts(generation));
+
+    // Setup is done once user data has run, so firework only considers the agent ready from then on
+    // and does not start dependent nodes against a VM that is still provisioning. Shell connections
+    // are accepted in the meantime.
+    let user_data = metadata.user_data.clone();
+    let cid = metadata.cid;
+    std::thread::spawn(move || {
+        if let Err(e) = run_user_data(&user_data) {
+            error!("Failed to run user data: {}", e);
+        }
+
+        if let Err(e) = serve_readiness(cid) {
+            error!("Failed to serve readiness checks: {}", e);
+        }
+    });
+
+    let listener = VsockListener::bind_with_cid_port(metadata.cid, SHELL_PORT)?;
 
     for stream in listener.incoming() {
         std::thread::spawn(|| {